@@ -0,0 +1,12 @@
+package chaintree
+
+import (
+	"context"
+	"io"
+)
+
+// ExportCAR writes the whole ChainTree (tree and chain) at its current tip as a CARv1 file,
+// use dag.ImportCAR to read it back into a store
+func (ct *ChainTree) ExportCAR(ctx context.Context, w io.Writer) error {
+	return ct.Dag.ExportCAR(ctx, w, nil)
+}
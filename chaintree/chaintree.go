@@ -8,11 +8,13 @@ import (
 
 	cid "github.com/ipfs/go-cid"
 	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
 	"github.com/quorumcontrol/messages/v2/build/go/gossip"
 	"github.com/quorumcontrol/messages/v2/build/go/signatures"
 	"github.com/quorumcontrol/messages/v2/build/go/transactions"
 
 	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/nodestore"
 	"github.com/quorumcontrol/chaintree/safewrap"
 	"github.com/quorumcontrol/chaintree/typecaster"
 )
@@ -30,6 +32,10 @@ const (
 	ErrUnknown                = 4
 	ErrBadHeight              = 5
 	ErrBadTip                 = 6
+	ErrInvalidTransaction     = 7
+	ErrInvalidSignature       = 8
+	ErrInvalidBlock           = 9
+	ErrSchemaViolation        = 10
 
 	TreeLabel     = "tree"
 	ChainLabel    = "chain"
@@ -104,8 +110,25 @@ func (rn *RootNode) Copy() *RootNode {
 	}
 }
 
+// Path is a path of keys in a tree, see ParsePath for its string form
 type Path []string
 
+// ParsePath parses a "/" separated path, where a "/" or "\" which is part of a key is
+// escaped with a "\" (see dag.ParsePath)
+func ParsePath(path string) (Path, error) {
+	keys, err := dag.ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return Path(keys), nil
+}
+
+// String returns the canonical string form of the path which ParsePath parses back into
+// the same keys
+func (p Path) String() string {
+	return dag.PathString(p)
+}
+
 type Block struct {
 	PreviousTip  *cid.Cid                    `refmt:"previousTip,omitempty" json:"previousTip,omitempty" cbor:"previousTip,omitempty"`
 	Height       uint64                      `refmt:"height" json:"height" cbor:"height"`
@@ -157,7 +180,13 @@ type ChainTree struct {
 	Transactors     map[transactions.Transaction_Type]TransactorFunc
 	BlockValidators []BlockValidatorFunc
 	Metadata        interface{}
-	root            *RootNode
+	// HeightIndex is optional, when set it is kept up to date by ProcessBlockImmutable (and
+	// so ProcessBlock), ProcessBlockWithReceipts and ProcessBlocks and used by AtHeight
+	HeightIndex HeightIndex
+	// ReceiptStore is optional, when set ProcessBlockWithReceipts stores the receipts
+	// of valid blocks in it (see Receipts)
+	ReceiptStore ReceiptStore
+	root         *RootNode
 }
 
 func NewChainTree(ctx context.Context, dag *dag.Dag, blockValidators []BlockValidatorFunc, transactors map[transactions.Transaction_Type]TransactorFunc) (*ChainTree, error) {
@@ -196,6 +225,8 @@ func (ct *ChainTree) At(ctx context.Context, tip *cid.Cid) (*ChainTree, error) {
 		Transactors:     ct.Transactors,
 		BlockValidators: ct.BlockValidators,
 		Metadata:        ct.Metadata,
+		HeightIndex:     ct.HeightIndex,
+		ReceiptStore:    ct.ReceiptStore,
 		root:            root,
 	}, nil
 }
@@ -215,6 +246,49 @@ func (ct *ChainTree) Tree(ctx context.Context) (*dag.Dag, error) {
 func (ct *ChainTree) ProcessBlockImmutable(ctx context.Context, blockWithHeaders *BlockWithHeaders) (newChainTree *ChainTree, valid bool, err error) {
 	ctx = logger.Start(ctx, "chaintree.ProcessBlockImmutable")
 	defer logger.Finish(ctx)
+
+	newChainTree, valid, err = ct.processBlock(ctx, blockWithHeaders, nil)
+	if err != nil || !valid {
+		return nil, valid, err
+	}
+	err = newChainTree.indexHeight(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return newChainTree, true, nil
+}
+
+// ProcessBlockWithReceipts works like ProcessBlockImmutable but also returns a receipt for every
+// transaction that was played. When a transaction fails the receipts stop at that transaction,
+// which carries the error. When the ChainTree has a ReceiptStore the receipts of a valid block
+// are stored in it (see Receipts), they are never part of the block itself so they can't change
+// the resulting tip. The returned result is never nil.
+func (ct *ChainTree) ProcessBlockWithReceipts(ctx context.Context, blockWithHeaders *BlockWithHeaders) (*BlockResult, error) {
+	ctx = logger.Start(ctx, "chaintree.ProcessBlockWithReceipts")
+	defer logger.Finish(ctx)
+
+	collector := &receiptCollector{}
+	newChainTree, valid, err := ct.processBlock(ctx, blockWithHeaders, collector)
+	if err == nil && valid {
+		if indexErr := newChainTree.indexHeight(ctx); indexErr != nil {
+			return &BlockResult{Receipts: collector.receipts}, indexErr
+		}
+	}
+	if err == nil && valid && ct.ReceiptStore != nil {
+		// receipts are keyed by the tip the block resulted in, which they are fully
+		// determined by, so storing them for a block that is never committed is harmless
+		if storeErr := ct.ReceiptStore.Put(ctx, newChainTree.Dag.Tip, collector.receipts); storeErr != nil {
+			return &BlockResult{Receipts: collector.receipts}, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error storing receipts: %v", storeErr)}
+		}
+	}
+	return &BlockResult{
+		ChainTree: newChainTree,
+		Valid:     valid,
+		Receipts:  collector.receipts,
+	}, err
+}
+
+func (ct *ChainTree) processBlock(ctx context.Context, blockWithHeaders *BlockWithHeaders, receipts *receiptCollector) (newChainTree *ChainTree, valid bool, err error) {
 	sw := &safewrap.SafeWrap{}
 
 	if blockWithHeaders == nil {
@@ -225,6 +299,8 @@ func (ct *ChainTree) ProcessBlockImmutable(ctx context.Context, blockWithHeaders
 	if err != nil {
 		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating new ChainTree: %v", err)}
 	}
+	newChainTree.HeightIndex = ct.HeightIndex
+	newChainTree.ReceiptStore = ct.ReceiptStore
 
 	// first validate the block
 	for _, validator := range newChainTree.BlockValidators {
@@ -247,10 +323,14 @@ func (ct *ChainTree) ProcessBlockImmutable(ctx context.Context, blockWithHeaders
 
 	newTree := newChainTree.Dag.WithNewTip(*root.Tree)
 
-	for _, transaction := range blockWithHeaders.Transactions {
+	for i, transaction := range blockWithHeaders.Transactions {
 		transactor, ok := newChainTree.Transactors[transaction.Type]
 		if !ok {
-			return nil, false, &ErrorCode{Code: ErrUnknownTransactionType, Memo: fmt.Sprintf("unknown transaction type: %v", transaction.Type)}
+			err := &ErrorCode{Code: ErrUnknownTransactionType, Memo: fmt.Sprintf("unknown transaction type: %v", transaction.Type)}
+			if receiptErr := receipts.add(ctx, i, transaction, newTree, nil, false, err); receiptErr != nil {
+				return nil, false, receiptErr
+			}
+			return nil, false, err
 		}
 
 		chainTreeDID, err := ct.Id(ctx)
@@ -258,7 +338,11 @@ func (ct *ChainTree) ProcessBlockImmutable(ctx context.Context, blockWithHeaders
 			return nil, false, fmt.Errorf("error getting ID of chaintree: %v", err)
 		}
 
+		treeBefore := newTree
 		newTree, valid, err = transactor(chainTreeDID, newTree, transaction)
+		if receiptErr := receipts.add(ctx, i, transaction, treeBefore, newTree, valid, err); receiptErr != nil {
+			return nil, false, receiptErr
+		}
 		if err != nil || !valid {
 			return nil, valid, err
 		}
@@ -383,6 +467,106 @@ func (ct *ChainTree) ProcessBlock(ctx context.Context, blockWithHeaders *BlockWi
 	return true, nil
 }
 
+// Simulation is the outcome of SimulateBlock
+type Simulation struct {
+	// ChainTree is the would-be new ChainTree, its Dag reads from an overlay which holds
+	// the new nodes in memory
+	ChainTree *ChainTree
+	// Tip is the would-be new tip
+	Tip cid.Cid
+	// Nodes are the nodes which would be added to the store, adding them makes the
+	// store hold the new tip
+	Nodes []format.Node
+}
+
+// SimulateBlock works like ProcessBlockImmutable but writes nothing to the store (nor the
+// HeightIndex), so it can be used to pre-validate blocks that may never be played.
+// The simulation is only returned for valid blocks.
+func (ct *ChainTree) SimulateBlock(ctx context.Context, blockWithHeaders *BlockWithHeaders) (simulation *Simulation, valid bool, err error) {
+	ctx = logger.Start(ctx, "chaintree.SimulateBlock")
+	defer logger.Finish(ctx)
+
+	overlay := nodestore.NewOverlay(ct.Dag.Store)
+	working, err := NewChainTree(ctx, dag.NewDag(ctx, ct.Dag.Tip, overlay), ct.BlockValidators, ct.Transactors)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating new ChainTree: %v", err)}
+	}
+	working.Metadata = ct.Metadata
+
+	newChainTree, valid, err := working.ProcessBlockImmutable(ctx, blockWithHeaders)
+	if err != nil || !valid {
+		return nil, valid, err
+	}
+
+	return &Simulation{
+		ChainTree: newChainTree,
+		Tip:       newChainTree.Dag.Tip,
+		Nodes:     overlay.Reachable(newChainTree.Dag.Tip),
+	}, true, nil
+}
+
+// ProcessBlocks plays the blocks in order as ProcessBlock would, but against an in-memory
+// overlay of the store. Once done only the nodes reachable from the new tip (the final
+// state and its chain) are written to the store, in a single batch. If a block fails
+// its index and error are returned and the ChainTree is left at the state after the last
+// valid block. failedIndex is -1 when every block was valid, or along with the error when
+// processing failed for a reason which has nothing to do with a particular block (e.g. the
+// store could not be written), in which case the ChainTree is left unchanged.
+func (ct *ChainTree) ProcessBlocks(ctx context.Context, blocks []*BlockWithHeaders) (failedIndex int, err CodedError) {
+	ctx = logger.Start(ctx, "chaintree.ProcessBlocks")
+	defer logger.Finish(ctx)
+
+	overlay := nodestore.NewOverlay(ct.Dag.Store)
+	working, newErr := NewChainTree(ctx, dag.NewDag(ctx, ct.Dag.Tip, overlay), ct.BlockValidators, ct.Transactors)
+	if newErr != nil {
+		return -1, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating new ChainTree: %v", newErr)}
+	}
+
+	failedIndex = -1
+	for i, block := range blocks {
+		newChainTree, valid, processErr := working.ProcessBlockImmutable(ctx, block)
+		if processErr != nil || !valid {
+			failedIndex = i
+			err = toCodedError(processErr, fmt.Sprintf("block %d is invalid", i))
+			break
+		}
+		working = newChainTree
+	}
+
+	if working.Dag.Tip.Equals(ct.Dag.Tip) {
+		return failedIndex, err
+	}
+
+	// the heights of every played block are indexed at once (indexHeight fills in the
+	// heights below the new tip), before the commit so the ChainTree never moves without
+	// being indexed
+	working.HeightIndex = ct.HeightIndex
+	indexErr := working.indexHeight(ctx)
+	if indexErr != nil {
+		return -1, toCodedError(indexErr, "error indexing heights")
+	}
+
+	_, commitErr := overlay.Commit(ctx, working.Dag.Tip)
+	if commitErr != nil {
+		return -1, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error committing nodes: %v", commitErr)}
+	}
+	ct.Dag = ct.Dag.WithNewTip(working.Dag.Tip)
+
+	return failedIndex, err
+}
+
+// toCodedError returns err as a CodedError, wrapping it if necessary. If err is nil
+// an ErrInvalidBlock with the memo is returned.
+func toCodedError(err error, memo string) CodedError {
+	if err == nil {
+		return &ErrorCode{Code: ErrInvalidBlock, Memo: memo}
+	}
+	if coded, ok := err.(CodedError); ok {
+		return coded
+	}
+	return &ErrorCode{Code: ErrUnknown, Memo: err.Error()}
+}
+
 func (ct *ChainTree) getRoot(ctx context.Context) (*RootNode, error) {
 	ctx = logger.Start(ctx, "chaintree.getRoot")
 
@@ -1,13 +1,18 @@
 package chaintree
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"strings"
 	"testing"
 
 	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
 	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
 	"github.com/quorumcontrol/chaintree/dag"
 	"github.com/quorumcontrol/chaintree/nodestore"
 	"github.com/quorumcontrol/chaintree/safewrap"
@@ -430,3 +435,255 @@ func BenchmarkEncodeDecode(b *testing.B) {
 	}
 	require.Nil(b, err)
 }
+
+// failingStore can be read from but fails every write
+type failingStore struct {
+	nodestore.DagStore
+}
+
+func (fs *failingStore) Add(context.Context, format.Node) error {
+	return fmt.Errorf("store is read only")
+}
+
+func (fs *failingStore) AddMany(context.Context, []format.Node) error {
+	return fmt.Errorf("store is read only")
+}
+
+func TestProcessBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsync.MutexWrap(datastore.NewMapDatastore())
+	store, err := nodestore.FromDatastoreOffline(ctx, ds)
+	require.Nil(t, err)
+
+	sw := &safewrap.SafeWrap{}
+	treeNode := sw.WrapObject(map[string]string{"hithere": "hothere"})
+	chainNode := sw.WrapObject(make(map[string]string))
+	root := sw.WrapObject(map[string]interface{}{
+		"chain": chainNode.Cid(),
+		"tree":  treeNode.Cid(),
+		"id":    "test",
+	})
+	require.Nil(t, sw.Err)
+
+	d, err := dag.NewDagWithNodes(ctx, store, root, treeNode, chainNode)
+	require.Nil(t, err)
+	tree, err := NewChainTree(
+		ctx,
+		d,
+		[]BlockValidatorFunc{hasCoolHeader},
+		map[transactions.Transaction_Type]TransactorFunc{
+			transactions.Transaction_SETDATA: setData,
+		},
+	)
+	require.Nil(t, err)
+
+	// blocks need the previous tip, so build them up against a throwaway copy
+	scratchDag, err := dag.NewDagWithNodes(ctx, nodestore.MustMemoryStore(ctx), root, treeNode, chainNode)
+	require.Nil(t, err)
+	scratch, err := NewChainTree(ctx, scratchDag, tree.BlockValidators, tree.Transactors)
+	require.Nil(t, err)
+
+	blocks := make([]*BlockWithHeaders, 4)
+	for i := range blocks {
+		txn, err := NewSetDataTransaction("down/in/the/thing", i)
+		require.Nil(t, err)
+		txn2, err := NewSetDataTransaction(fmt.Sprintf("other/%d", i), i)
+		require.Nil(t, err)
+		blocks[i] = &BlockWithHeaders{
+			Block: Block{
+				Height:       uint64(i),
+				Transactions: []*transactions.Transaction{txn, txn2},
+			},
+			Headers: map[string]interface{}{
+				"cool": "cool",
+			},
+		}
+		if i > 0 {
+			blocks[i].PreviousTip = &scratch.Dag.Tip
+		}
+		valid, err := scratch.ProcessBlock(ctx, blocks[i])
+		require.Nil(t, err)
+		require.True(t, valid)
+	}
+
+	t.Run("stops at the first invalid block", func(t *testing.T) {
+		invalid := *blocks[2]
+		invalid.Headers = map[string]interface{}{"cool": "not cool"}
+
+		failed, err := tree.ProcessBlocks(ctx, []*BlockWithHeaders{blocks[0], blocks[1], &invalid, blocks[3]})
+		assert.Equal(t, 2, failed)
+		require.NotNil(t, err)
+		assert.Equal(t, ErrInvalidBlock, err.GetCode())
+
+		height, _, resolveErr := tree.Dag.Resolve(ctx, []string{"height"})
+		require.Nil(t, resolveErr)
+		assert.Equal(t, 1, height)
+	})
+
+	t.Run("failures unrelated to a block have no index", func(t *testing.T) {
+		broken, err := NewChainTree(ctx, dag.NewDag(ctx, root.Cid(), &failingStore{DagStore: store}), tree.BlockValidators, tree.Transactors)
+		require.Nil(t, err)
+
+		failed, codedErr := broken.ProcessBlocks(ctx, blocks[:1])
+		assert.Equal(t, -1, failed)
+		require.NotNil(t, codedErr)
+		assert.Equal(t, ErrUnknown, codedErr.GetCode())
+	})
+
+	t.Run("continues from where it left off", func(t *testing.T) {
+		failed, err := tree.ProcessBlocks(ctx, blocks[2:])
+		assert.Equal(t, -1, failed)
+		require.Nil(t, err)
+		assert.Equal(t, scratch.Dag.Tip.String(), tree.Dag.Tip.String())
+
+		val, _, resolveErr := tree.Dag.Resolve(ctx, []string{"tree", "down", "in", "the", "thing"})
+		require.Nil(t, resolveErr)
+		assert.Equal(t, 3, val)
+	})
+
+	t.Run("only writes reachable nodes", func(t *testing.T) {
+		// the genesis block does not link back to the starting state, so count both
+		reachable := make(map[cid.Cid]struct{})
+		for _, tip := range []cid.Cid{root.Cid(), tree.Dag.Tip} {
+			nodes, err := tree.Dag.WithNewTip(tip).Nodes(ctx)
+			require.Nil(t, err)
+			for _, n := range nodes {
+				reachable[n.Cid()] = struct{}{}
+			}
+		}
+
+		results, err := ds.Query(query.Query{KeysOnly: true})
+		require.Nil(t, err)
+		entries, err := results.Rest()
+		require.Nil(t, err)
+		assert.Len(t, entries, len(reachable))
+	})
+}
+
+func TestSimulateBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsync.MutexWrap(datastore.NewMapDatastore())
+	store, err := nodestore.FromDatastoreOffline(ctx, ds)
+	require.Nil(t, err)
+
+	sw := &safewrap.SafeWrap{}
+	treeNode := sw.WrapObject(map[string]string{"hithere": "hothere"})
+	chainNode := sw.WrapObject(make(map[string]string))
+	root := sw.WrapObject(map[string]interface{}{
+		"chain": chainNode.Cid(),
+		"tree":  treeNode.Cid(),
+		"id":    "test",
+	})
+	require.Nil(t, sw.Err)
+
+	d, err := dag.NewDagWithNodes(ctx, store, root, treeNode, chainNode)
+	require.Nil(t, err)
+	tree, err := NewChainTree(
+		ctx,
+		d,
+		[]BlockValidatorFunc{hasCoolHeader},
+		map[transactions.Transaction_Type]TransactorFunc{
+			transactions.Transaction_SETDATA: setData,
+		},
+	)
+	require.Nil(t, err)
+	tree.HeightIndex = NewDatastoreHeightIndex(ds)
+
+	countEntries := func() int {
+		results, err := ds.Query(query.Query{KeysOnly: true})
+		require.Nil(t, err)
+		entries, err := results.Rest()
+		require.Nil(t, err)
+		return len(entries)
+	}
+	startingEntries := countEntries()
+
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	block := &BlockWithHeaders{
+		Block: Block{
+			Transactions: []*transactions.Transaction{txn},
+		},
+		Headers: map[string]interface{}{
+			"cool": "cool",
+		},
+	}
+
+	t.Run("invalid blocks write nothing", func(t *testing.T) {
+		invalid := *block
+		invalid.Headers = map[string]interface{}{"cool": "not cool"}
+		sim, valid, err := tree.SimulateBlock(ctx, &invalid)
+		require.Nil(t, err)
+		require.False(t, valid)
+		assert.Nil(t, sim)
+		assert.Equal(t, startingEntries, countEntries())
+	})
+
+	sim, valid, err := tree.SimulateBlock(ctx, block)
+	require.Nil(t, err)
+	require.True(t, valid)
+	assert.Equal(t, startingEntries, countEntries())
+	assert.Equal(t, root.Cid().String(), tree.Dag.Tip.String())
+
+	val, _, err := sim.ChainTree.Dag.Resolve(ctx, []string{"tree", "down", "in", "the", "thing"})
+	require.Nil(t, err)
+	assert.Equal(t, "hi", val)
+
+	blockCid := sw.WrapObject(block).Cid()
+	require.Nil(t, sw.Err)
+	var hasBlock bool
+	for _, n := range sim.Nodes {
+		if n.Cid().Equals(blockCid) {
+			hasBlock = true
+		}
+	}
+	assert.True(t, hasBlock)
+
+	// adding the simulated nodes is enough to move to the simulated tip
+	err = tree.Dag.AddNodes(ctx, sim.Nodes...)
+	require.Nil(t, err)
+	simulated, err := tree.At(ctx, &sim.Tip)
+	require.Nil(t, err)
+	val, _, err = simulated.Dag.Resolve(ctx, []string{"tree", "down", "in", "the", "thing"})
+	require.Nil(t, err)
+	assert.Equal(t, "hi", val)
+
+	valid, err = tree.ProcessBlock(ctx, block)
+	require.Nil(t, err)
+	require.True(t, valid)
+	assert.Equal(t, sim.Tip.String(), tree.Dag.Tip.String())
+}
+
+func TestExportCAR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	buf := &bytes.Buffer{}
+	err = ct.ExportCAR(ctx, buf)
+	require.Nil(t, err)
+
+	store := nodestore.MustMemoryStore(ctx)
+	root, err := dag.ImportCAR(ctx, store, buf)
+	require.Nil(t, err)
+
+	imported, err := NewChainTree(ctx, dag.NewDag(ctx, root, store), nil, DefaultTransactors())
+	require.Nil(t, err)
+	val, _, err := imported.Dag.Resolve(ctx, []string{TreeLabel, "down", "in", "the", "thing"})
+	require.Nil(t, err)
+	assert.Equal(t, "hi", val)
+
+	height, err := imported.Height(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), height)
+}
@@ -0,0 +1,241 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// HeightIndex maps the heights of chaintrees to the tip they had at that height.
+// Get returns a nil tip (and no error) when it doesn't know the height. Deleting a
+// height which isn't in the index is not an error.
+type HeightIndex interface {
+	Put(ctx context.Context, chainTreeID string, height uint64, tip cid.Cid) error
+	Get(ctx context.Context, chainTreeID string, height uint64) (*cid.Cid, error)
+	Delete(ctx context.Context, chainTreeID string, height uint64) error
+}
+
+var heightIndexPrefix = datastore.NewKey("heights")
+
+// DatastoreHeightIndex is a HeightIndex persisted in a datastore, it can share
+// the datastore used by the nodestore.
+type DatastoreHeightIndex struct {
+	ds datastore.Datastore
+}
+
+var _ HeightIndex = (*DatastoreHeightIndex)(nil)
+
+// NewDatastoreHeightIndex returns a HeightIndex which stores its entries
+// under /heights in ds
+func NewDatastoreHeightIndex(ds datastore.Datastore) *DatastoreHeightIndex {
+	return &DatastoreHeightIndex{ds: ds}
+}
+
+func (hi *DatastoreHeightIndex) key(chainTreeID string, height uint64) datastore.Key {
+	return heightIndexPrefix.ChildString(chainTreeID).ChildString(strconv.FormatUint(height, 10))
+}
+
+func (hi *DatastoreHeightIndex) Put(_ context.Context, chainTreeID string, height uint64, tip cid.Cid) error {
+	return hi.ds.Put(hi.key(chainTreeID, height), tip.Bytes())
+}
+
+func (hi *DatastoreHeightIndex) Get(_ context.Context, chainTreeID string, height uint64) (*cid.Cid, error) {
+	bits, err := hi.ds.Get(hi.key(chainTreeID, height))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting height %d of %s: %v", height, chainTreeID, err)
+	}
+	tip, err := cid.Cast(bits)
+	if err != nil {
+		return nil, fmt.Errorf("error casting tip: %v", err)
+	}
+	return &tip, nil
+}
+
+func (hi *DatastoreHeightIndex) Delete(_ context.Context, chainTreeID string, height uint64) error {
+	err := hi.ds.Delete(hi.key(chainTreeID, height))
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Height returns the height of the chaintree (the height of the last block in the chain)
+func (ct *ChainTree) Height(ctx context.Context) (uint64, error) {
+	root, err := ct.getRoot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return root.Height, nil
+}
+
+// AtHeight returns a new ChainTree at the tip it had after the block of the given height
+// was played. The tip is taken from the HeightIndex (when set) if the index holds this
+// chain, otherwise the chain is walked backwards from the current tip to find it.
+func (ct *ChainTree) AtHeight(ctx context.Context, height uint64) (*ChainTree, error) {
+	ctx = logger.Start(ctx, "chaintree.AtHeight")
+	defer logger.Finish(ctx)
+
+	root, err := ct.getRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ct.chainEnd(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if end == nil || height > root.Height {
+		return nil, &ErrorCode{Code: ErrBadHeight, Memo: fmt.Sprintf("chaintree has no height %d", height)}
+	}
+	if height == root.Height {
+		return ct.At(ctx, &ct.Dag.Tip)
+	}
+
+	if ct.HeightIndex != nil {
+		indexed, err := ct.indexedTip(ctx, root, height)
+		if err != nil {
+			return nil, err
+		}
+		if indexed != nil {
+			return ct.At(ctx, indexed)
+		}
+	}
+
+	tip, err := ct.tipAtHeight(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	return ct.At(ctx, tip)
+}
+
+// indexedTip returns the tip the HeightIndex has for height, or nil when the index
+// can't be trusted for this chain. indexHeight keeps the heights of a chaintree in the
+// index on a single chain, so when the index has the current tip at the current height
+// every lower height it has is an ancestor of the current tip.
+func (ct *ChainTree) indexedTip(ctx context.Context, root *RootNode, height uint64) (*cid.Cid, error) {
+	top, err := ct.HeightIndex.Get(ctx, root.Id, root.Height)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting tip from index: %v", err)}
+	}
+	if top == nil || !top.Equals(ct.Dag.Tip) {
+		return nil, nil
+	}
+	tip, err := ct.HeightIndex.Get(ctx, root.Id, height)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting tip from index: %v", err)}
+	}
+	if tip == nil {
+		return nil, nil
+	}
+	indexedRoot, err := ct.getRootAt(ctx, *tip)
+	if err != nil || indexedRoot.Id != root.Id || indexedRoot.Height != height {
+		return nil, nil
+	}
+	return tip, nil
+}
+
+// indexHeight adds the current tip to the HeightIndex (if there is one). The heights of a
+// chaintree in the index always form a single chain: when the tip isn't a descendant of
+// the chain in the index the chain is walked back to where they agree (or to the genesis
+// block), the heights of the old chain from there up are removed and the heights of this
+// one are written oldest first.
+func (ct *ChainTree) indexHeight(ctx context.Context) error {
+	if ct.HeightIndex == nil {
+		return nil
+	}
+	root, err := ct.getRoot(ctx)
+	if err != nil {
+		return err
+	}
+	indexErr := func(err error) error {
+		return &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error updating height index: %v", err)}
+	}
+
+	// the tips to write, newest first
+	tips := []cid.Cid{ct.Dag.Tip}
+	indexed, err := ct.HeightIndex.Get(ctx, root.Id, root.Height)
+	if err != nil {
+		return indexErr(err)
+	}
+	if indexed != nil && indexed.Equals(ct.Dag.Tip) {
+		return nil
+	}
+	if root.Height > 0 {
+		iter, err := ct.Blocks(ctx)
+		if err != nil {
+			return err
+		}
+		for iter.Next() {
+			block := iter.Block()
+			if block.PreviousTip == nil {
+				break
+			}
+			indexed, err := ct.HeightIndex.Get(ctx, root.Id, block.Height-1)
+			if err != nil {
+				return indexErr(err)
+			}
+			if indexed != nil && indexed.Equals(*block.PreviousTip) {
+				break
+			}
+			tips = append(tips, *block.PreviousTip)
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	lowest := root.Height - uint64(len(tips)-1)
+
+	// the heights from lowest up belong to another chain, they're removed newest first
+	// so the index never holds a tip at the top of a chain with a height of another one
+	// below it
+	stale := lowest
+	for {
+		existing, err := ct.HeightIndex.Get(ctx, root.Id, stale)
+		if err != nil {
+			return indexErr(err)
+		}
+		if existing == nil {
+			break
+		}
+		stale++
+	}
+	for stale > lowest {
+		stale--
+		if err := ct.HeightIndex.Delete(ctx, root.Id, stale); err != nil {
+			return indexErr(err)
+		}
+	}
+
+	for i := len(tips) - 1; i >= 0; i-- {
+		err = ct.HeightIndex.Put(ctx, root.Id, root.Height-uint64(i), tips[i])
+		if err != nil {
+			return indexErr(err)
+		}
+	}
+	return nil
+}
+
+// tipAtHeight walks the chain backwards from the current tip to the block after height,
+// which points to the tip at height
+func (ct *ChainTree) tipAtHeight(ctx context.Context, height uint64) (*cid.Cid, error) {
+	iter, err := ct.BlocksBetween(ctx, height+1, height+1)
+	if err != nil {
+		return nil, err
+	}
+	if !iter.Next() {
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		return nil, &ErrorCode{Code: ErrBadHeight, Memo: fmt.Sprintf("no block found at height %d", height+1)}
+	}
+	tip := iter.Block().PreviousTip
+	if tip == nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("block at height %d has no previous tip", height+1)}
+	}
+	return tip, nil
+}
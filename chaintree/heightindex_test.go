@@ -0,0 +1,264 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/nodestore"
+)
+
+func TestAtHeight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, test := range []struct {
+		description string
+		index       HeightIndex
+	}{
+		{description: "without an index"},
+		{description: "with an index", index: NewDatastoreHeightIndex(dsync.MutexWrap(datastore.NewMapDatastore()))},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+			ct.HeightIndex = test.index
+
+			_, err := ct.AtHeight(ctx, 0)
+			require.NotNil(t, err)
+
+			tips := make(map[uint64]string)
+			for i := 0; i < 4; i++ {
+				txn, err := NewSetDataTransaction("count", i)
+				require.Nil(t, err)
+				valid, err := processTransactions(ctx, ct, txn)
+				require.Nil(t, err)
+				require.True(t, valid)
+				tips[uint64(i)] = ct.Dag.Tip.String()
+			}
+
+			for height, tip := range tips {
+				old, err := ct.AtHeight(ctx, height)
+				require.Nil(t, err)
+				assert.Equal(t, tip, old.Dag.Tip.String())
+
+				count, _, err := old.Dag.Resolve(ctx, []string{TreeLabel, "count"})
+				require.Nil(t, err)
+				assert.Equal(t, int(height), count)
+			}
+
+			_, err = ct.AtHeight(ctx, 4)
+			require.NotNil(t, err)
+			assert.Equal(t, ErrBadHeight, err.(CodedError).GetCode())
+		})
+	}
+
+	t.Run("the index is filled in by the next block", func(t *testing.T) {
+		ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+		for i := 0; i < 3; i++ {
+			txn, err := NewSetDataTransaction("count", i)
+			require.Nil(t, err)
+			valid, err := processTransactions(ctx, ct, txn)
+			require.Nil(t, err)
+			require.True(t, valid)
+		}
+
+		index := NewDatastoreHeightIndex(dsync.MutexWrap(datastore.NewMapDatastore()))
+		ct.HeightIndex = index
+
+		old, err := ct.AtHeight(ctx, 1)
+		require.Nil(t, err)
+
+		// looking up a height never writes to the index
+		tip, err := index.Get(ctx, "did:tupelo:test", 1)
+		require.Nil(t, err)
+		assert.Nil(t, tip)
+
+		txn, err := NewSetDataTransaction("count", 3)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.Nil(t, err)
+		require.True(t, valid)
+
+		for height := uint64(0); height <= 3; height++ {
+			tip, err = index.Get(ctx, "did:tupelo:test", height)
+			require.Nil(t, err)
+			require.NotNil(t, tip)
+		}
+		tip, err = index.Get(ctx, "did:tupelo:test", 1)
+		require.Nil(t, err)
+		assert.Equal(t, old.Dag.Tip.String(), tip.String())
+	})
+}
+
+// countingStore counts the nodes read from the store
+type countingStore struct {
+	nodestore.DagStore
+	gets int
+}
+
+func (cs *countingStore) Get(ctx context.Context, id cid.Cid) (format.Node, error) {
+	cs.gets++
+	return cs.DagStore.Get(ctx, id)
+}
+
+func TestAtHeightUsesTheIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	ct.HeightIndex = NewDatastoreHeightIndex(dsync.MutexWrap(datastore.NewMapDatastore()))
+	var first cid.Cid
+	for i := 0; i < 20; i++ {
+		txn, err := NewSetDataTransaction("count", i)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.Nil(t, err)
+		require.True(t, valid)
+		if i == 0 {
+			first = ct.Dag.Tip
+		}
+	}
+
+	atHeight := func(index HeightIndex) int {
+		store := &countingStore{DagStore: ct.Dag.Store}
+		counted, err := NewChainTree(ctx, dag.NewDag(ctx, ct.Dag.Tip, store), nil, DefaultTransactors())
+		require.Nil(t, err)
+		counted.HeightIndex = index
+		store.gets = 0
+
+		old, err := counted.AtHeight(ctx, 0)
+		require.Nil(t, err)
+		assert.True(t, old.Dag.Tip.Equals(first))
+		return store.gets
+	}
+
+	assert.GreaterOrEqual(t, atHeight(nil), 20)
+	assert.LessOrEqual(t, atHeight(ct.HeightIndex), 3)
+}
+
+func TestAtHeightWithForks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	ct.HeightIndex = NewDatastoreHeightIndex(dsync.MutexWrap(datastore.NewMapDatastore()))
+
+	txn, err := NewSetDataTransaction("count", 0)
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+	parent := ct.Dag.Tip
+
+	block := func(value string) *BlockWithHeaders {
+		txn, err := NewSetDataTransaction("value", value)
+		require.Nil(t, err)
+		return &BlockWithHeaders{
+			Block: Block{
+				PreviousTip:  &parent,
+				Height:       1,
+				Transactions: []*transactions.Transaction{txn},
+			},
+		}
+	}
+
+	valid, err = ct.ProcessBlock(ctx, block("canonical"))
+	require.Nil(t, err)
+	require.True(t, valid)
+	canonical := ct.Dag.Tip
+
+	// a competing block from the same parent, ProcessBlockImmutable indexes it
+	base, err := ct.At(ctx, &parent)
+	require.Nil(t, err)
+	fork, valid, err := base.ProcessBlockImmutable(ctx, block("fork"))
+	require.Nil(t, err)
+	require.True(t, valid)
+	assert.False(t, fork.Dag.Tip.Equals(canonical))
+	indexed, err := ct.HeightIndex.Get(ctx, "did:tupelo:test", 1)
+	require.Nil(t, err)
+	assert.True(t, indexed.Equals(fork.Dag.Tip))
+
+	for height := uint64(2); height <= 3; height++ {
+		txn, err = NewSetDataTransaction("value", "next")
+		require.Nil(t, err)
+		valid, err = fork.ProcessBlock(ctx, &BlockWithHeaders{
+			Block: Block{
+				PreviousTip:  &fork.Dag.Tip,
+				Height:       height,
+				Transactions: []*transactions.Transaction{txn},
+			},
+		})
+		require.Nil(t, err)
+		require.True(t, valid)
+	}
+
+	// the index holds the fork, so the chain is walked instead
+	old, err := ct.AtHeight(ctx, 0)
+	require.Nil(t, err)
+	assert.True(t, old.Dag.Tip.Equals(parent))
+
+	old, err = fork.AtHeight(ctx, 1)
+	require.Nil(t, err)
+	assert.False(t, old.Dag.Tip.Equals(canonical))
+
+	// a shorter chain replaces every height of the fork in the index
+	txn, err = NewSetDataTransaction("value", "after canonical")
+	require.Nil(t, err)
+	valid, err = processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	indexed, err = ct.HeightIndex.Get(ctx, "did:tupelo:test", 1)
+	require.Nil(t, err)
+	assert.True(t, indexed.Equals(canonical))
+	indexed, err = ct.HeightIndex.Get(ctx, "did:tupelo:test", 3)
+	require.Nil(t, err)
+	assert.Nil(t, indexed)
+
+	for _, chain := range []*ChainTree{ct, fork} {
+		old, err = chain.AtHeight(ctx, 1)
+		require.Nil(t, err)
+		assert.Equal(t, chain == ct, old.Dag.Tip.Equals(canonical))
+	}
+}
+
+// failingHeightIndex fails every write
+type failingHeightIndex struct {
+	HeightIndex
+}
+
+func (fhi *failingHeightIndex) Put(_ context.Context, _ string, _ uint64, _ cid.Cid) error {
+	return fmt.Errorf("failed")
+}
+
+func TestIndexErrorsLeaveTheChainTreeUnchanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	ct.HeightIndex = &failingHeightIndex{HeightIndex: NewDatastoreHeightIndex(dsync.MutexWrap(datastore.NewMapDatastore()))}
+	tip := ct.Dag.Tip
+
+	txn, err := NewSetDataTransaction("count", 0)
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.NotNil(t, err)
+	assert.False(t, valid)
+	assert.True(t, ct.Dag.Tip.Equals(tip))
+
+	failedIndex, codedErr := ct.ProcessBlocks(ctx, []*BlockWithHeaders{{
+		Block: Block{Transactions: []*transactions.Transaction{txn}},
+	}})
+	require.NotNil(t, codedErr)
+	assert.Equal(t, -1, failedIndex)
+	assert.True(t, ct.Dag.Tip.Equals(tip))
+}
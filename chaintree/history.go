@@ -0,0 +1,132 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+
+	"github.com/quorumcontrol/chaintree/dag"
+)
+
+// BlockIterator walks the chain of a ChainTree from its end back towards the genesis
+// block by following each block's PreviousBlock. Use it like a bufio.Scanner:
+//
+//	iter, err := ct.Blocks(ctx)
+//	for iter.Next() {
+//		block := iter.Block()
+//	}
+//	err = iter.Err()
+type BlockIterator struct {
+	ctx     context.Context
+	dag     *dag.Dag
+	next    *cid.Cid
+	from    uint64
+	to      uint64
+	current *BlockWithHeaders
+	cid     cid.Cid
+	err     error
+}
+
+// Blocks returns an iterator over every block in the chain, newest first
+func (ct *ChainTree) Blocks(ctx context.Context) (*BlockIterator, error) {
+	return ct.BlocksBetween(ctx, 0, math.MaxUint64)
+}
+
+// BlocksBetween returns an iterator over the blocks with a height between from and
+// to (inclusive), newest first
+func (ct *ChainTree) BlocksBetween(ctx context.Context, from, to uint64) (*BlockIterator, error) {
+	if from > to {
+		return nil, fmt.Errorf("from (%d) must not be greater than to (%d)", from, to)
+	}
+
+	end, err := ct.chainEnd(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockIterator{
+		ctx:  ctx,
+		dag:  ct.Dag,
+		next: end,
+		from: from,
+		to:   to,
+	}, nil
+}
+
+// chainEnd returns the CID of the last block in the chain or nil if there are no blocks yet
+func (ct *ChainTree) chainEnd(ctx context.Context) (*cid.Cid, error) {
+	root, err := ct.getRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if root.Chain == nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: "chain link is nil"}
+	}
+
+	chainNode, err := ct.Dag.Get(ctx, *root.Chain)
+	if err != nil || chainNode == nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error getting chain node: %v", err)}
+	}
+	chain := &Chain{}
+	err = cbornode.DecodeInto(chainNode.RawData(), chain)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error decoding chain: %v", err)}
+	}
+	return chain.End, nil
+}
+
+// Next advances the iterator to the next (older) block and returns false when there
+// are no more blocks or when an error occured (see Err).
+func (bi *BlockIterator) Next() bool {
+	for bi.err == nil && bi.next != nil {
+		id := *bi.next
+
+		node, err := bi.dag.Get(bi.ctx, id)
+		if err != nil || node == nil {
+			bi.err = &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error getting block %s: %v", id, err)}
+			break
+		}
+
+		block := &BlockWithHeaders{}
+		err = cbornode.DecodeInto(node.RawData(), block)
+		if err != nil {
+			bi.err = &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error decoding block %s: %v", id, err)}
+			break
+		}
+
+		bi.next = block.PreviousBlock
+		if block.Height < bi.from {
+			// every block after this one is even older
+			bi.next = nil
+			break
+		}
+		if block.Height > bi.to {
+			continue
+		}
+
+		bi.current = block
+		bi.cid = id
+		return true
+	}
+
+	bi.current = nil
+	return false
+}
+
+// Block returns the block the iterator is currently at
+func (bi *BlockIterator) Block() *BlockWithHeaders {
+	return bi.current
+}
+
+// Cid returns the CID of the block the iterator is currently at
+func (bi *BlockIterator) Cid() cid.Cid {
+	return bi.cid
+}
+
+// Err returns the first error encountered while iterating
+func (bi *BlockIterator) Err() error {
+	return bi.err
+}
@@ -0,0 +1,77 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+
+	t.Run("empty chain", func(t *testing.T) {
+		iter, err := ct.Blocks(ctx)
+		require.Nil(t, err)
+		assert.False(t, iter.Next())
+		assert.Nil(t, iter.Err())
+	})
+
+	for i := 0; i < 5; i++ {
+		txn, err := NewSetDataTransaction("count", i)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.Nil(t, err)
+		require.True(t, valid)
+	}
+
+	t.Run("walks from end to genesis", func(t *testing.T) {
+		iter, err := ct.Blocks(ctx)
+		require.Nil(t, err)
+
+		sw := &safewrap.SafeWrap{}
+		expected := uint64(4)
+		count := 0
+		for iter.Next() {
+			block := iter.Block()
+			assert.Equal(t, expected, block.Height)
+			assert.Equal(t, iter.Cid(), sw.WrapObject(block).Cid())
+			require.Nil(t, sw.Err)
+			if expected > 0 {
+				assert.NotNil(t, block.PreviousBlock)
+				assert.NotNil(t, block.PreviousTip)
+			}
+			expected--
+			count++
+		}
+		require.Nil(t, iter.Err())
+		assert.Equal(t, 5, count)
+		assert.Nil(t, iter.Block())
+	})
+
+	t.Run("walks between heights", func(t *testing.T) {
+		iter, err := ct.BlocksBetween(ctx, 1, 3)
+		require.Nil(t, err)
+
+		heights := []uint64{}
+		for iter.Next() {
+			heights = append(heights, iter.Block().Height)
+			payload := iter.Block().Transactions[0].SetDataPayload
+			assert.Equal(t, "count", payload.Path, fmt.Sprintf("height %d", iter.Block().Height))
+		}
+		require.Nil(t, iter.Err())
+		assert.Equal(t, []uint64{3, 2, 1}, heights)
+	})
+
+	t.Run("rejects backwards ranges", func(t *testing.T) {
+		_, err := ct.BlocksBetween(ctx, 3, 1)
+		require.NotNil(t, err)
+	})
+}
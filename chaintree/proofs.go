@@ -0,0 +1,115 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+
+	"github.com/quorumcontrol/chaintree/dag"
+)
+
+// ProveValue returns the nodes needed to prove the value at path (relative to the tree)
+// at the current tip of the ChainTree. The nodes are ordered from the root node of the
+// ChainTree, through the tree node, down to the node holding the value. When the value is
+// itself a linked node, that node is the last one in the proof. Sharded maps along the
+// path contribute the nodes on the way to the key, which can't be a sharded map itself.
+func (ct *ChainTree) ProveValue(ctx context.Context, path Path) ([]format.Node, error) {
+	cur, err := ct.Dag.Get(ctx, ct.Dag.Tip)
+	if err != nil || cur == nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error getting tip: %v", err)}
+	}
+
+	nodes := []format.Node{cur}
+	remaining := append(Path{TreeLabel}, path...)
+	shardDepth := 0
+	for {
+		// resolving the empty path makes sure the last node isn't part of a sharded map
+		val, rest, nextShardDepth, err := dag.ResolveNode(cur, remaining, shardDepth)
+		if err != nil {
+			return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("no value at path %v: %v", path, err)}
+		}
+		link, ok := val.(*format.Link)
+		if !ok || len(remaining) == 0 {
+			if len(rest) > 0 {
+				return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("no value at path %v", path)}
+			}
+			return nodes, nil
+		}
+
+		next, err := ct.Dag.Get(ctx, link.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("error getting node (%s): %v", link.Cid.String(), err)
+		}
+		if next == nil {
+			return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("missing node at path %v", path)}
+		}
+		nodes = append(nodes, next)
+		cur = next
+		remaining = rest
+		shardDepth = nextShardDepth
+	}
+}
+
+// VerifyValueProof checks a proof produced by ProveValue against tip without needing
+// a store and returns the proven value. Every node is rehashed so the proof can come
+// from an untrusted source.
+func VerifyValueProof(tip cid.Cid, path Path, proof []format.Node) (interface{}, error) {
+	if len(proof) == 0 {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: "empty proof"}
+	}
+
+	remaining := append(Path{TreeLabel}, path...)
+	expected := tip
+	shardDepth := 0
+	for i, n := range proof {
+		node, err := decodeProofNode(expected, n)
+		if err != nil {
+			return nil, err
+		}
+
+		val, rest, nextShardDepth, err := dag.ResolveNode(node, remaining, shardDepth)
+		if err != nil {
+			return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error resolving %v: %v", remaining, err)}
+		}
+		link, isLink := val.(*format.Link)
+		if !isLink || len(remaining) == 0 {
+			if len(rest) > 0 {
+				return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("no value at path %v", path)}
+			}
+			if i != len(proof)-1 {
+				return nil, &ErrorCode{Code: ErrInvalidTree, Memo: "proof has extra nodes"}
+			}
+			return val, nil
+		}
+		expected = link.Cid
+		remaining = rest
+		shardDepth = nextShardDepth
+	}
+
+	return nil, &ErrorCode{Code: ErrInvalidTree, Memo: "proof is missing nodes"}
+}
+
+// decodeProofNode makes sure the node really hashes to expected and decodes it from
+// its raw bytes rather than trusting the node it was handed
+func decodeProofNode(expected cid.Cid, n format.Node) (format.Node, error) {
+	sum, err := expected.Prefix().Sum(n.RawData())
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error hashing node: %v", err)}
+	}
+	if !sum.Equals(expected) {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("node does not match %s", expected.String())}
+	}
+	blk, err := blocks.NewBlockWithCid(n.RawData(), expected)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error creating block: %v", err)}
+	}
+	node, err := cbornode.DecodeBlock(blk)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrInvalidTree, Memo: fmt.Sprintf("error decoding node: %v", err)}
+	}
+	return node, nil
+}
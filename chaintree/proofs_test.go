@@ -0,0 +1,110 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestValueProofs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	path := Path{"down", "in", "the", "thing"}
+	proof, err := ct.ProveValue(ctx, path)
+	require.Nil(t, err)
+	// root, tree, down, in, the
+	assert.Len(t, proof, 5)
+
+	val, err := VerifyValueProof(ct.Dag.Tip, path, proof)
+	require.Nil(t, err)
+	assert.Equal(t, "hi", val)
+
+	t.Run("linked values", func(t *testing.T) {
+		proof, err := ct.ProveValue(ctx, Path{"down", "in"})
+		require.Nil(t, err)
+		assert.Len(t, proof, 4)
+
+		val, err := VerifyValueProof(ct.Dag.Tip, Path{"down", "in"}, proof)
+		require.Nil(t, err)
+		assert.IsType(t, map[string]interface{}{}, val)
+	})
+
+	t.Run("missing values", func(t *testing.T) {
+		_, err := ct.ProveValue(ctx, Path{"down", "nope"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("bad proofs", func(t *testing.T) {
+		_, err := VerifyValueProof(ct.Dag.Tip, path, nil)
+		assert.NotNil(t, err)
+
+		_, err = VerifyValueProof(ct.Dag.Tip, path, proof[:3])
+		assert.NotNil(t, err)
+
+		_, err = VerifyValueProof(ct.Dag.Tip, Path{"down", "in"}, proof)
+		assert.NotNil(t, err)
+
+		_, err = VerifyValueProof(ct.Dag.Tip, Path{"down", "in", "other"}, proof)
+		assert.NotNil(t, err)
+
+		sw := &safewrap.SafeWrap{}
+		forged := sw.WrapObject(map[string]interface{}{"thing": "bye"})
+		require.Nil(t, sw.Err)
+		tampered := append(append([]format.Node{}, proof[:4]...), forged)
+		_, err = VerifyValueProof(ct.Dag.Tip, path, tampered)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("sharded maps", func(t *testing.T) {
+		sharded, err := ct.Dag.ShardMap(ctx, []string{TreeLabel, "sharded"})
+		require.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			sharded, err = sharded.Set(ctx, []string{TreeLabel, "sharded", fmt.Sprintf("key%d", i)}, i)
+			require.Nil(t, err)
+		}
+		sharded, err = sharded.Set(ctx, []string{TreeLabel, "sharded", "key1", "below"}, "value")
+		require.Nil(t, err)
+		ct, err := NewChainTree(ctx, sharded, nil, DefaultTransactors())
+		require.Nil(t, err)
+
+		path := Path{"sharded", "key7"}
+		proof, err := ct.ProveValue(ctx, path)
+		require.Nil(t, err)
+		// root, tree and at least the root of the sharded map
+		assert.Greater(t, len(proof), 2)
+		val, err := VerifyValueProof(ct.Dag.Tip, path, proof)
+		require.Nil(t, err)
+		assert.Equal(t, 7, val)
+
+		path = Path{"sharded", "key1", "below"}
+		proof, err = ct.ProveValue(ctx, path)
+		require.Nil(t, err)
+		val, err = VerifyValueProof(ct.Dag.Tip, path, proof)
+		require.Nil(t, err)
+		assert.Equal(t, "value", val)
+
+		_, err = ct.ProveValue(ctx, Path{"sharded", "nope"})
+		assert.NotNil(t, err)
+		// a whole sharded map can't be proven with a single node
+		_, err = ct.ProveValue(ctx, Path{"sharded"})
+		assert.NotNil(t, err)
+
+		_, err = VerifyValueProof(ct.Dag.Tip, Path{"sharded", "key8"}, proof)
+		assert.NotNil(t, err)
+	})
+}
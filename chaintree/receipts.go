@@ -0,0 +1,155 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/typecaster"
+)
+
+func init() {
+	cbornode.RegisterCborType(TransactionReceipt{})
+	cbornode.RegisterCborType(ErrorCode{})
+
+	typecaster.AddType(TransactionReceipt{})
+	typecaster.AddType(ErrorCode{})
+}
+
+// TransactionReceipt records what a single transaction in a block did to the tree
+type TransactionReceipt struct {
+	Index        int                           `refmt:"index" json:"index" cbor:"index"`
+	Type         transactions.Transaction_Type `refmt:"type" json:"type" cbor:"type"`
+	TreeBefore   cid.Cid                       `refmt:"treeBefore" json:"treeBefore" cbor:"treeBefore"`
+	TreeAfter    *cid.Cid                      `refmt:"treeAfter,omitempty" json:"treeAfter,omitempty" cbor:"treeAfter,omitempty"`
+	ChangedPaths []Path                        `refmt:"changedPaths,omitempty" json:"changedPaths,omitempty" cbor:"changedPaths,omitempty"`
+	Error        *ErrorCode                    `refmt:"error,omitempty" json:"error,omitempty" cbor:"error,omitempty"`
+}
+
+// BlockResult is returned from ProcessBlockWithReceipts. ChainTree is nil unless
+// the block was valid.
+type BlockResult struct {
+	ChainTree *ChainTree
+	Valid     bool
+	Receipts  []*TransactionReceipt
+}
+
+// receiptCollector gathers receipts while a block is processed, a nil collector
+// ignores everything.
+type receiptCollector struct {
+	receipts []*TransactionReceipt
+}
+
+func (rc *receiptCollector) add(ctx context.Context, index int, transaction *transactions.Transaction, before, after *dag.Dag, valid bool, err error) error {
+	if rc == nil {
+		return nil
+	}
+
+	receipt := &TransactionReceipt{
+		Index:      index,
+		Type:       transaction.Type,
+		TreeBefore: before.Tip,
+	}
+
+	switch {
+	case err != nil:
+		receipt.Error = toErrorCode(err)
+	case !valid:
+		receipt.Error = &ErrorCode{Code: ErrInvalidTransaction, Memo: "transaction is invalid"}
+	default:
+		afterTip := after.Tip
+		receipt.TreeAfter = &afterTip
+		changed, err := dag.ChangedPaths(ctx, before, after)
+		if err != nil {
+			return &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting changed paths: %v", err)}
+		}
+		for _, p := range changed {
+			receipt.ChangedPaths = append(receipt.ChangedPaths, Path(p))
+		}
+	}
+
+	rc.receipts = append(rc.receipts, receipt)
+	return nil
+}
+
+func toErrorCode(err error) *ErrorCode {
+	switch e := err.(type) {
+	case *ErrorCode:
+		return e
+	case CodedError:
+		return &ErrorCode{Code: e.GetCode(), Memo: e.Error()}
+	default:
+		return &ErrorCode{Code: ErrUnknown, Memo: err.Error()}
+	}
+}
+
+// ReceiptStore keeps receipts outside of the chain, so whether or not a node stores them
+// never changes its tips. Receipts are stored by the tip their block resulted in. Get
+// returns nil (and no error) when it has no receipts for the tip.
+type ReceiptStore interface {
+	Put(ctx context.Context, tip cid.Cid, receipts []*TransactionReceipt) error
+	Get(ctx context.Context, tip cid.Cid) ([]*TransactionReceipt, error)
+}
+
+var receiptStorePrefix = datastore.NewKey("receipts")
+
+// DatastoreReceiptStore is a ReceiptStore persisted in a datastore, it can share
+// the datastore used by the nodestore.
+type DatastoreReceiptStore struct {
+	ds datastore.Datastore
+}
+
+var _ ReceiptStore = (*DatastoreReceiptStore)(nil)
+
+// NewDatastoreReceiptStore returns a ReceiptStore which stores its entries
+// under /receipts in ds
+func NewDatastoreReceiptStore(ds datastore.Datastore) *DatastoreReceiptStore {
+	return &DatastoreReceiptStore{ds: ds}
+}
+
+func (rs *DatastoreReceiptStore) key(tip cid.Cid) datastore.Key {
+	return receiptStorePrefix.ChildString(tip.String())
+}
+
+func (rs *DatastoreReceiptStore) Put(_ context.Context, tip cid.Cid, receipts []*TransactionReceipt) error {
+	bits, err := cbornode.DumpObject(receipts)
+	if err != nil {
+		return fmt.Errorf("error encoding receipts: %v", err)
+	}
+	return rs.ds.Put(rs.key(tip), bits)
+}
+
+func (rs *DatastoreReceiptStore) Get(_ context.Context, tip cid.Cid) ([]*TransactionReceipt, error) {
+	bits, err := rs.ds.Get(rs.key(tip))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting receipts for %s: %v", tip.String(), err)
+	}
+	var receipts []*TransactionReceipt
+	err = cbornode.DecodeInto(bits, &receipts)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding receipts: %v", err)
+	}
+	return receipts, nil
+}
+
+// Receipts returns the receipts of the block which resulted in the current tip, when they
+// were stored by ProcessBlockWithReceipts. Without a ReceiptStore, or for a tip without
+// stored receipts, it returns nil. Use At or AtHeight for the receipts of earlier blocks.
+func (ct *ChainTree) Receipts(ctx context.Context) ([]*TransactionReceipt, error) {
+	if ct.ReceiptStore == nil {
+		return nil, nil
+	}
+	receipts, err := ct.ReceiptStore.Get(ctx, ct.Dag.Tip)
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting receipts: %v", err)}
+	}
+	return receipts, nil
+}
@@ -0,0 +1,120 @@
+package chaintree
+
+import (
+	"context"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBlockWithReceipts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	ct.ReceiptStore = NewDatastoreReceiptStore(dsync.MutexWrap(datastore.NewMapDatastore()))
+
+	setData, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	setOther, err := NewSetDataTransaction("other", 1)
+	require.Nil(t, err)
+
+	block := &BlockWithHeaders{
+		Block: Block{
+			Transactions: []*transactions.Transaction{setData, setOther},
+		},
+	}
+
+	result, err := ct.ProcessBlockWithReceipts(ctx, block)
+	require.Nil(t, err)
+	require.True(t, result.Valid)
+	require.NotNil(t, result.ChainTree)
+	require.Len(t, result.Receipts, 2)
+
+	first := result.Receipts[0]
+	assert.Equal(t, 0, first.Index)
+	assert.Equal(t, transactions.Transaction_SETDATA, first.Type)
+	assert.Nil(t, first.Error)
+	require.NotNil(t, first.TreeAfter)
+	assert.Equal(t, []Path{{"down"}}, first.ChangedPaths)
+
+	second := result.Receipts[1]
+	assert.Equal(t, 1, second.Index)
+	assert.True(t, second.TreeBefore.Equals(*first.TreeAfter))
+	assert.Equal(t, []Path{{"other"}}, second.ChangedPaths)
+
+	tree, err := result.ChainTree.Tree(ctx)
+	require.Nil(t, err)
+	assert.True(t, tree.Tip.Equals(*second.TreeAfter))
+
+	stored, err := result.ChainTree.Receipts(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, result.Receipts, stored)
+
+	t.Run("storing receipts does not change the tip", func(t *testing.T) {
+		ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+		unstored, err := ct.ProcessBlockWithReceipts(ctx, block)
+		require.Nil(t, err)
+		require.True(t, unstored.Valid)
+		assert.True(t, unstored.ChainTree.Dag.Tip.Equals(result.ChainTree.Dag.Tip))
+
+		receipts, err := unstored.ChainTree.Receipts(ctx)
+		require.Nil(t, err)
+		assert.Nil(t, receipts)
+	})
+
+	t.Run("a failing transaction gets a receipt with the error", func(t *testing.T) {
+		mint, err := NewMintTokenTransaction("unknown", 1)
+		require.Nil(t, err)
+
+		block := &BlockWithHeaders{
+			Block: Block{
+				PreviousTip:  &result.ChainTree.Dag.Tip,
+				Height:       1,
+				Transactions: []*transactions.Transaction{setData, mint, setOther},
+			},
+		}
+
+		failed, err := result.ChainTree.ProcessBlockWithReceipts(ctx, block)
+		require.NotNil(t, err)
+		assert.False(t, failed.Valid)
+		assert.Nil(t, failed.ChainTree)
+		require.Len(t, failed.Receipts, 2)
+
+		assert.Nil(t, failed.Receipts[0].Error)
+		assert.Len(t, failed.Receipts[0].ChangedPaths, 0)
+
+		require.NotNil(t, failed.Receipts[1].Error)
+		assert.Equal(t, ErrInvalidTransaction, failed.Receipts[1].Error.GetCode())
+		assert.Nil(t, failed.Receipts[1].TreeAfter)
+	})
+
+	t.Run("earlier receipts are found through At", func(t *testing.T) {
+		block := &BlockWithHeaders{
+			Block: Block{
+				PreviousTip:  &result.ChainTree.Dag.Tip,
+				Height:       1,
+				Transactions: []*transactions.Transaction{setOther},
+			},
+		}
+
+		next, err := result.ChainTree.ProcessBlockWithReceipts(ctx, block)
+		require.Nil(t, err)
+		assert.True(t, next.Valid)
+		assert.Len(t, next.Receipts, 1)
+
+		receipts, err := next.ChainTree.Receipts(ctx)
+		require.Nil(t, err)
+		assert.Equal(t, next.Receipts, receipts)
+
+		previous, err := next.ChainTree.At(ctx, &result.ChainTree.Dag.Tip)
+		require.Nil(t, err)
+		receipts, err = previous.Receipts(ctx)
+		require.Nil(t, err)
+		assert.Equal(t, result.Receipts, receipts)
+	})
+}
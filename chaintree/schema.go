@@ -0,0 +1,366 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+
+	"github.com/quorumcontrol/chaintree/dag"
+)
+
+// SchemaType is the kind of value a Schema allows
+type SchemaType string
+
+const (
+	SchemaAny    SchemaType = ""
+	SchemaString SchemaType = "string"
+	// SchemaInt allows any integer
+	SchemaInt SchemaType = "int"
+	// SchemaNumber allows integers and floats
+	SchemaNumber SchemaType = "number"
+	SchemaBool   SchemaType = "bool"
+	SchemaBytes  SchemaType = "bytes"
+	SchemaMap    SchemaType = "map"
+	SchemaList   SchemaType = "list"
+)
+
+// Schema describes the data allowed at a path of a tree. It is a small subset of JSON
+// schema and can be decoded from JSON. Links are followed, so a map stored as its own
+// node is checked like any other map.
+type Schema struct {
+	Type SchemaType `refmt:"type,omitempty" json:"type,omitempty" cbor:"type,omitempty"`
+
+	// Properties are the schemas of the known keys of a map
+	Properties map[string]*Schema `refmt:"properties,omitempty" json:"properties,omitempty" cbor:"properties,omitempty"`
+	// Required are the keys a map must have
+	Required []string `refmt:"required,omitempty" json:"required,omitempty" cbor:"required,omitempty"`
+	// AdditionalProperties is the schema of the keys of a map which aren't in Properties,
+	// nil allows anything
+	AdditionalProperties *Schema `refmt:"additionalProperties,omitempty" json:"additionalProperties,omitempty" cbor:"additionalProperties,omitempty"`
+	// Closed rejects maps with keys which aren't in Properties
+	Closed bool `refmt:"closed,omitempty" json:"closed,omitempty" cbor:"closed,omitempty"`
+
+	// Items is the schema of every element of a list, nil allows anything
+	Items *Schema `refmt:"items,omitempty" json:"items,omitempty" cbor:"items,omitempty"`
+}
+
+// SchemaError is returned for data which doesn't match its schema, Path is the full
+// path (relative to the tree) of the offending value
+type SchemaError struct {
+	Path   Path
+	Reason string
+}
+
+func (e *SchemaError) GetCode() int {
+	return ErrSchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%d - schema violation at %s: %s", ErrSchemaViolation, e.Path, e.Reason)
+}
+
+// SchemaRegistry holds the schemas of a tree by path. Wrap transactors with it (see
+// Transactors) to make every transaction which leaves the tree violating a schema invalid.
+// The schemas are checked after every transaction rather than by a BlockValidatorFunc,
+// since those only ever see the tree from before the block.
+type SchemaRegistry struct {
+	schemas []*registeredSchema
+}
+
+type registeredSchema struct {
+	path   Path
+	schema *Schema
+}
+
+// NewSchemaRegistry returns an empty SchemaRegistry
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{}
+}
+
+// Register sets the schema for the value at path (relative to the tree). A path with
+// nothing at it is fine, the schema only applies to values which exist. Schemas
+// registered at nested paths all apply.
+func (sr *SchemaRegistry) Register(path Path, schema *Schema) error {
+	if len(path) == 0 {
+		return fmt.Errorf("path must not be empty")
+	}
+	if schema == nil {
+		return fmt.Errorf("schema must not be nil")
+	}
+	if err := schema.check(); err != nil {
+		return fmt.Errorf("invalid schema for %s: %v", path, err)
+	}
+	for _, registered := range sr.schemas {
+		if pathEqual(registered.path, path) {
+			return fmt.Errorf("a schema is already registered for %s", path)
+		}
+	}
+
+	sr.schemas = append(sr.schemas, &registeredSchema{path: append(Path{}, path...), schema: schema})
+	sort.Slice(sr.schemas, func(i, j int) bool {
+		return sr.schemas[i].path.String() < sr.schemas[j].path.String()
+	})
+	return nil
+}
+
+// Validate checks everything in tree against the registered schemas, the first violation
+// is returned as a *SchemaError
+func (sr *SchemaRegistry) Validate(ctx context.Context, tree *dag.Dag) error {
+	for _, registered := range sr.schemas {
+		if err := registered.validateAll(ctx, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transactors returns transactors with every one of them wrapped by Transactor
+func (sr *SchemaRegistry) Transactors(transactors map[transactions.Transaction_Type]TransactorFunc) map[transactions.Transaction_Type]TransactorFunc {
+	wrapped := make(map[transactions.Transaction_Type]TransactorFunc, len(transactors))
+	for typ, transactor := range transactors {
+		wrapped[typ] = sr.Transactor(transactor)
+	}
+	return wrapped
+}
+
+// Transactor wraps transactor so that transactions which leave the tree violating a
+// registered schema are invalid with a *SchemaError. Only the parts of the tree which
+// the transaction changed are checked.
+func (sr *SchemaRegistry) Transactor(transactor TransactorFunc) TransactorFunc {
+	return func(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction) (*dag.Dag, bool, CodedError) {
+		newTree, valid, codedErr := transactor(chainTreeDID, tree, transaction)
+		if codedErr != nil || !valid {
+			return newTree, valid, codedErr
+		}
+		err := sr.validateChanges(context.TODO(), tree, newTree)
+		if err != nil {
+			return nil, false, toCodedError(err, "error validating schemas")
+		}
+		return newTree, true, nil
+	}
+}
+
+func (sr *SchemaRegistry) validateChanges(ctx context.Context, before, after *dag.Dag) error {
+	if len(sr.schemas) == 0 {
+		return nil
+	}
+	changes, err := dag.Diff(ctx, before, after)
+	if err != nil {
+		return fmt.Errorf("error diffing trees: %v", err)
+	}
+	for _, change := range changes {
+		for _, registered := range sr.schemas {
+			var err error
+			switch {
+			case pathHasPrefix(registered.path, change.Path):
+				// everything at the registered path may have changed
+				err = registered.validateAll(ctx, after)
+			case pathHasPrefix(change.Path, registered.path):
+				err = registered.validateChange(ctx, after, change)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rs *registeredSchema) validateAll(ctx context.Context, tree *dag.Dag) error {
+	val, remaining, err := tree.Resolve(ctx, rs.path)
+	if err != nil {
+		return fmt.Errorf("error resolving %v: %v", rs.path, err)
+	}
+	if val == nil || len(remaining) > 0 {
+		return nil
+	}
+	return rs.schema.validate(ctx, tree, rs.path, val)
+}
+
+// validateChange checks a change below the registered path
+func (rs *registeredSchema) validateChange(ctx context.Context, tree *dag.Dag, change *dag.Change) error {
+	parent := rs.schema
+	for i := len(rs.path); i < len(change.Path)-1 && parent != nil; i++ {
+		var err error
+		parent, err = parent.child(change.Path[:i], change.Path[i])
+		if err != nil {
+			return err
+		}
+	}
+	if parent == nil {
+		return nil
+	}
+
+	parentPath := change.Path[:len(change.Path)-1]
+	key := change.Path[len(change.Path)-1]
+	if change.Type == dag.Removed {
+		for _, required := range parent.Required {
+			if required == key {
+				return &SchemaError{Path: parentPath, Reason: fmt.Sprintf("missing required key %q", key)}
+			}
+		}
+		return nil
+	}
+
+	schema, err := parent.child(parentPath, key)
+	if err != nil || schema == nil {
+		return err
+	}
+	return schema.validate(ctx, tree, change.Path, change.NewValue)
+}
+
+// child returns the schema for key of the map at path, nil when anything goes
+func (s *Schema) child(path Path, key string) (*Schema, error) {
+	switch s.Type {
+	case SchemaAny:
+		return nil, nil
+	case SchemaMap:
+		if child, ok := s.Properties[key]; ok {
+			return child, nil
+		}
+		if s.Closed {
+			return nil, &SchemaError{Path: appendPath(path, key), Reason: "unexpected key"}
+		}
+		return s.AdditionalProperties, nil
+	default:
+		return nil, &SchemaError{Path: path, Reason: fmt.Sprintf("expected %s, got map", s.Type)}
+	}
+}
+
+func (s *Schema) validate(ctx context.Context, tree *dag.Dag, path Path, val interface{}) error {
+	if id, ok := val.(cid.Cid); ok {
+		resolved, _, err := tree.ResolveAt(ctx, id, nil)
+		if err != nil {
+			return fmt.Errorf("error resolving %v: %v", path, err)
+		}
+		val = resolved
+	}
+
+	ok := true
+	switch s.Type {
+	case SchemaAny:
+	case SchemaString:
+		_, ok = val.(string)
+	case SchemaInt:
+		ok = isInt(val)
+	case SchemaNumber:
+		switch val.(type) {
+		case float32, float64:
+		default:
+			ok = isInt(val)
+		}
+	case SchemaBool:
+		_, ok = val.(bool)
+	case SchemaBytes:
+		_, ok = val.([]byte)
+	case SchemaMap:
+		obj, isMap := val.(map[string]interface{})
+		if !isMap {
+			ok = false
+			break
+		}
+		for _, required := range s.Required {
+			if _, exists := obj[required]; !exists {
+				return &SchemaError{Path: path, Reason: fmt.Sprintf("missing required key %q", required)}
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child, err := s.child(path, k)
+			if err != nil {
+				return err
+			}
+			if child == nil {
+				continue
+			}
+			if err := child.validate(ctx, tree, appendPath(path, k), obj[k]); err != nil {
+				return err
+			}
+		}
+	case SchemaList:
+		list, isList := val.([]interface{})
+		if !isList {
+			ok = false
+			break
+		}
+		if s.Items == nil {
+			break
+		}
+		for i, item := range list {
+			if err := s.Items.validate(ctx, tree, appendPath(path, fmt.Sprint(i)), item); err != nil {
+				return err
+			}
+		}
+	}
+	if !ok {
+		return &SchemaError{Path: path, Reason: fmt.Sprintf("expected %s, got %T", s.Type, val)}
+	}
+	return nil
+}
+
+// check returns an error for schemas which can never be valid
+func (s *Schema) check() error {
+	switch s.Type {
+	case SchemaAny, SchemaString, SchemaInt, SchemaNumber, SchemaBool, SchemaBytes, SchemaList:
+		if len(s.Properties) > 0 || len(s.Required) > 0 || s.AdditionalProperties != nil || s.Closed {
+			return fmt.Errorf("only maps can have properties")
+		}
+	case SchemaMap:
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+	if s.Items != nil && s.Type != SchemaList {
+		return fmt.Errorf("only lists can have items")
+	}
+
+	var children []*Schema
+	for _, child := range s.Properties {
+		children = append(children, child)
+	}
+	children = append(children, s.AdditionalProperties, s.Items)
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := child.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isInt(val interface{}) bool {
+	switch val.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	default:
+		return false
+	}
+}
+
+func pathHasPrefix(path, prefix Path) bool {
+	return len(path) >= len(prefix) && pathEqual(path[:len(prefix)], prefix)
+}
+
+func pathEqual(a, b Path) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendPath(path Path, key string) Path {
+	return append(append(Path{}, path...), key)
+}
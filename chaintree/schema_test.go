@@ -0,0 +1,110 @@
+package chaintree
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	schema := &Schema{}
+	err := json.Unmarshal([]byte(`{
+		"type": "map",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string"},
+			"tags": {"type": "list", "items": {"type": "string"}}
+		},
+		"additionalProperties": {"type": "int"}
+	}`), schema)
+	require.Nil(t, err)
+
+	registry := NewSchemaRegistry()
+	require.Nil(t, registry.Register(Path{"profile"}, schema))
+	require.NotNil(t, registry.Register(Path{"profile"}, schema))
+	require.NotNil(t, registry.Register(Path{"bad"}, &Schema{Type: "nope"}))
+	require.NotNil(t, registry.Register(Path{"bad"}, &Schema{Type: SchemaString, Required: []string{"a"}}))
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+	ct.Transactors = registry.Transactors(DefaultTransactors())
+
+	txn, err := NewSetDataTransaction("profile", map[string]interface{}{"name": "alice", "age": 30})
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	txn, err = NewSetDataTransaction("unrelated/path", "anything")
+	require.Nil(t, err)
+	valid, err = processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	for _, test := range []struct {
+		description string
+		path        string
+		value       interface{}
+		errorPath   Path
+	}{
+		{description: "wrong type", path: "profile/name", value: 1, errorPath: Path{"profile", "name"}},
+		{description: "wrong additional property", path: "profile/age", value: "old", errorPath: Path{"profile", "age"}},
+		{description: "wrong list item", path: "profile/tags", value: []interface{}{"a", 1}, errorPath: Path{"profile", "tags", "1"}},
+		{description: "wrong type below a property", path: "profile/name/first", value: "alice", errorPath: Path{"profile", "name"}},
+		{description: "replacing the whole value", path: "profile", value: map[string]interface{}{"age": 1}, errorPath: Path{"profile"}},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			txn, err := NewSetDataTransaction(test.path, test.value)
+			require.Nil(t, err)
+			tip := ct.Dag.Tip
+			valid, err := processTransactions(ctx, ct, txn)
+			require.False(t, valid)
+			require.NotNil(t, err)
+			schemaErr, ok := err.(*SchemaError)
+			require.True(t, ok, "unexpected error: %v", err)
+			assert.Equal(t, ErrSchemaViolation, schemaErr.GetCode())
+			assert.Equal(t, test.errorPath, schemaErr.Path)
+			assert.True(t, tip.Equals(ct.Dag.Tip))
+		})
+	}
+
+	txn, err = NewSetDataTransaction("profile/tags", []interface{}{"a", "b"})
+	require.Nil(t, err)
+	valid, err = processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	tree, err := ct.Tree(ctx)
+	require.Nil(t, err)
+	require.Nil(t, registry.Validate(ctx, tree))
+
+	t.Run("removing a required key", func(t *testing.T) {
+		removed, err := tree.Delete(ctx, []string{"profile", "name"})
+		require.Nil(t, err)
+		err = registry.validateChanges(ctx, tree, removed)
+		require.NotNil(t, err)
+		assert.Equal(t, Path{"profile"}, err.(*SchemaError).Path)
+		assert.NotNil(t, registry.Validate(ctx, removed))
+
+		removed, err = tree.Delete(ctx, []string{"profile", "age"})
+		require.Nil(t, err)
+		require.Nil(t, registry.validateChanges(ctx, tree, removed))
+	})
+
+	t.Run("closed maps", func(t *testing.T) {
+		closed := NewSchemaRegistry()
+		require.Nil(t, closed.Register(Path{"profile"}, &Schema{
+			Type:       SchemaMap,
+			Properties: map[string]*Schema{"name": {Type: SchemaString}},
+			Closed:     true,
+		}))
+		err := closed.Validate(ctx, tree)
+		require.NotNil(t, err)
+		assert.Equal(t, Path{"profile", "age"}, err.(*SchemaError).Path)
+	})
+}
@@ -0,0 +1,267 @@
+package chaintree
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/quorumcontrol/messages/v2/build/go/signatures"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/pairing/bn256"
+	"go.dedis.ch/kyber/v3/sign/bls"
+
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/quorumcontrol/chaintree/typecaster"
+)
+
+const (
+	// SignaturesHeader is the key of BlockWithHeaders.Headers that SignBlock writes to
+	SignaturesHeader = "signatures"
+
+	// DIDPrefix is the prefix of a chaintree ID whose remainder is the address of
+	// the genesis owner
+	DIDPrefix = "did:tupelo:"
+)
+
+var blsSuite = bn256.NewSuite()
+
+// StandardHeaders is the typed form of the BlockWithHeaders.Headers understood by
+// this package. Signatures are keyed by the address of the signer.
+type StandardHeaders struct {
+	Signatures map[string]*signatures.Signature `refmt:"signatures,omitempty" json:"signatures,omitempty" cbor:"signatures,omitempty"`
+}
+
+// GetStandardHeaders returns the typed form of the block's headers
+func (bwh *BlockWithHeaders) GetStandardHeaders() (*StandardHeaders, error) {
+	headers := &StandardHeaders{}
+	// only cast the known keys so that blocks can carry other headers too
+	if sigs, ok := bwh.Headers[SignaturesHeader]; ok && sigs != nil {
+		err := typecaster.ToType(sigs, &headers.Signatures)
+		if err != nil {
+			return nil, fmt.Errorf("error casting signatures: %v", err)
+		}
+	}
+	return headers, nil
+}
+
+// BlockDigest returns the bytes that signers of a block sign: the sha256 of the cbor
+// encoding of the block (without headers).
+func BlockDigest(block *Block) ([]byte, error) {
+	sw := &safewrap.SafeWrap{}
+	n := sw.WrapObject(block)
+	if sw.Err != nil {
+		return nil, fmt.Errorf("error wrapping block: %v", sw.Err)
+	}
+	digest := sha256.Sum256(n.RawData())
+	return digest[:], nil
+}
+
+// PublicKeyToAddress returns the address an owner is known by in the
+// authentications of a tree. Both key types use the ethereum address scheme.
+func PublicKeyToAddress(key *signatures.PublicKey) (string, error) {
+	if key == nil {
+		return "", fmt.Errorf("public key must not be nil")
+	}
+	switch key.Type {
+	case signatures.PublicKey_KeyTypeSecp256k1:
+		ecdsaKey, err := crypto.UnmarshalPubkey(key.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("error unmarshaling public key: %v", err)
+		}
+		return crypto.PubkeyToAddress(*ecdsaKey).String(), nil
+	case signatures.PublicKey_KeyTypeBLSGroupSig:
+		return common.BytesToAddress(crypto.Keccak256(key.PublicKey)[12:]).String(), nil
+	default:
+		return "", fmt.Errorf("unknown key type: %v", key.Type)
+	}
+}
+
+// SignBlock returns a copy of the block with a secp256k1 signature by key added to
+// its StandardHeaders. Other headers are left untouched.
+func SignBlock(_ context.Context, blockWithHeaders *BlockWithHeaders, key *ecdsa.PrivateKey) (*BlockWithHeaders, error) {
+	digest, err := BlockDigest(&blockWithHeaders.Block)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(digest, key)
+	if err != nil {
+		return nil, fmt.Errorf("error signing block: %v", err)
+	}
+
+	publicKey := &signatures.PublicKey{
+		Type:      signatures.PublicKey_KeyTypeSecp256k1,
+		PublicKey: crypto.FromECDSAPub(&key.PublicKey),
+	}
+	return withSignature(blockWithHeaders, publicKey, sig)
+}
+
+// SignBlockWithBLS returns a copy of the block with a BLS signature by key added to
+// its StandardHeaders. Other headers are left untouched.
+func SignBlockWithBLS(_ context.Context, blockWithHeaders *BlockWithHeaders, key kyber.Scalar) (*BlockWithHeaders, error) {
+	digest, err := BlockDigest(&blockWithHeaders.Block)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := bls.Sign(blsSuite, key, digest)
+	if err != nil {
+		return nil, fmt.Errorf("error signing block: %v", err)
+	}
+
+	publicKeyBytes, err := blsSuite.G2().Point().Mul(key, nil).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling public key: %v", err)
+	}
+	publicKey := &signatures.PublicKey{
+		Type:      signatures.PublicKey_KeyTypeBLSGroupSig,
+		PublicKey: publicKeyBytes,
+	}
+	return withSignature(blockWithHeaders, publicKey, sig)
+}
+
+func withSignature(blockWithHeaders *BlockWithHeaders, publicKey *signatures.PublicKey, sig []byte) (*BlockWithHeaders, error) {
+	addr, err := PublicKeyToAddress(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := blockWithHeaders.GetStandardHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if headers.Signatures == nil {
+		headers.Signatures = make(map[string]*signatures.Signature)
+	}
+	headers.Signatures[addr] = &signatures.Signature{
+		Ownership: &signatures.Ownership{PublicKey: publicKey},
+		Signature: sig,
+	}
+
+	signed := *blockWithHeaders
+	signed.Headers = make(map[string]interface{}, len(blockWithHeaders.Headers)+1)
+	for k, v := range blockWithHeaders.Headers {
+		signed.Headers[k] = v
+	}
+	signed.Headers[SignaturesHeader] = headers.Signatures
+	return &signed, nil
+}
+
+// VerifySignature checks that sig is a valid signature over digest by the
+// signature's ownership public key.
+func VerifySignature(digest []byte, sig *signatures.Signature) (bool, error) {
+	if sig == nil || sig.Ownership == nil || sig.Ownership.PublicKey == nil {
+		return false, fmt.Errorf("signature must have an ownership public key")
+	}
+	key := sig.Ownership.PublicKey
+	switch key.Type {
+	case signatures.PublicKey_KeyTypeSecp256k1:
+		if len(sig.Signature) != 65 {
+			return false, nil
+		}
+		recovered, err := crypto.SigToPub(digest, sig.Signature)
+		if err != nil {
+			return false, nil
+		}
+		return bytes.Equal(crypto.FromECDSAPub(recovered), key.PublicKey), nil
+	case signatures.PublicKey_KeyTypeBLSGroupSig:
+		point := blsSuite.G2().Point()
+		err := point.UnmarshalBinary(key.PublicKey)
+		if err != nil {
+			return false, fmt.Errorf("error unmarshaling public key: %v", err)
+		}
+		return bls.Verify(blsSuite, point, digest, sig.Signature) == nil, nil
+	default:
+		return false, fmt.Errorf("unknown key type: %v", key.Type)
+	}
+}
+
+// Authentications returns the addresses allowed to sign blocks for the chaintree
+// whose whole DAG (not just the tree) is given. Until a SETOWNERSHIP transaction
+// has been played that is the address in the chaintree's DID.
+func Authentications(ctx context.Context, chainTree *dag.Dag) ([]string, error) {
+	path := append(Path{TreeLabel}, TreePathForAuthentications...)
+	uncast, remaining, err := chainTree.Resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving authentications: %v", err)
+	}
+	if uncast != nil && len(remaining) == 0 {
+		list, ok := uncast.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("authentications must be a list, was: %T", uncast)
+		}
+		auths := make([]string, len(list))
+		for i, a := range list {
+			addr, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("authentication must be a string, was: %T", a)
+			}
+			auths[i] = addr
+		}
+		return auths, nil
+	}
+
+	uncastID, _, err := chainTree.Resolve(ctx, []string{"id"})
+	if err != nil {
+		return nil, fmt.Errorf("error resolving id: %v", err)
+	}
+	id, ok := uncastID.(string)
+	if !ok || !strings.HasPrefix(id, DIDPrefix) {
+		return nil, fmt.Errorf("chaintree has no authentications and id %v is not a DID", uncastID)
+	}
+	return []string{strings.TrimPrefix(id, DIDPrefix)}, nil
+}
+
+// SignatureValidator is a BlockValidatorFunc which requires every signature in the
+// block's StandardHeaders to be valid and at least one of them to be by an address
+// in the current Authentications of the chaintree.
+func SignatureValidator(chainTree *dag.Dag, blockWithHeaders *BlockWithHeaders) (valid bool, err CodedError) {
+	ctx := context.TODO()
+
+	headers, castErr := blockWithHeaders.GetStandardHeaders()
+	if castErr != nil {
+		return false, &ErrorCode{Code: ErrInvalidSignature, Memo: castErr.Error()}
+	}
+	if len(headers.Signatures) == 0 {
+		return false, &ErrorCode{Code: ErrInvalidSignature, Memo: "block is not signed"}
+	}
+
+	auths, authErr := Authentications(ctx, chainTree)
+	if authErr != nil {
+		return false, &ErrorCode{Code: ErrUnknown, Memo: authErr.Error()}
+	}
+
+	digest, digestErr := BlockDigest(&blockWithHeaders.Block)
+	if digestErr != nil {
+		return false, &ErrorCode{Code: ErrUnknown, Memo: digestErr.Error()}
+	}
+
+	signedByOwner := false
+	for addr, sig := range headers.Signatures {
+		verified, verifyErr := VerifySignature(digest, sig)
+		if verifyErr != nil {
+			return false, &ErrorCode{Code: ErrInvalidSignature, Memo: fmt.Sprintf("error verifying signature of %s: %v", addr, verifyErr)}
+		}
+		if !verified {
+			return false, &ErrorCode{Code: ErrInvalidSignature, Memo: fmt.Sprintf("invalid signature from %s", addr)}
+		}
+		keyAddr, addrErr := PublicKeyToAddress(sig.Ownership.PublicKey)
+		if addrErr != nil || keyAddr != addr {
+			return false, &ErrorCode{Code: ErrInvalidSignature, Memo: fmt.Sprintf("signature key does not match address %s", addr)}
+		}
+		for _, auth := range auths {
+			if strings.EqualFold(auth, addr) {
+				signedByOwner = true
+			}
+		}
+	}
+
+	if !signedByOwner {
+		return false, &ErrorCode{Code: ErrInvalidSignature, Memo: "block is not signed by an owner"}
+	}
+	return true, nil
+}
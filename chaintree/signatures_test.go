@@ -0,0 +1,196 @@
+package chaintree
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/quorumcontrol/messages/v2/build/go/signatures"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3/util/random"
+
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestSignBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := crypto.GenerateKey()
+	require.Nil(t, err)
+
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	block := &BlockWithHeaders{
+		Block: Block{
+			Transactions: []*transactions.Transaction{txn},
+		},
+		Headers: map[string]interface{}{
+			"cool": "cool",
+		},
+	}
+
+	signed, err := SignBlock(ctx, block, key)
+	require.Nil(t, err)
+	assert.Equal(t, "cool", signed.Headers["cool"])
+	assert.Nil(t, block.Headers[SignaturesHeader])
+
+	headers, err := signed.GetStandardHeaders()
+	require.Nil(t, err)
+	addr := crypto.PubkeyToAddress(key.PublicKey).String()
+	require.Contains(t, headers.Signatures, addr)
+
+	digest, err := BlockDigest(&signed.Block)
+	require.Nil(t, err)
+	verified, err := VerifySignature(digest, headers.Signatures[addr])
+	require.Nil(t, err)
+	assert.True(t, verified)
+
+	// survives a round trip through cbor
+	sw := &safewrap.SafeWrap{}
+	decoded := &BlockWithHeaders{}
+	wrapped := sw.WrapObject(signed)
+	require.Nil(t, sw.Err)
+	err = cbornode.DecodeInto(wrapped.RawData(), decoded)
+	require.Nil(t, err)
+	headers, err = decoded.GetStandardHeaders()
+	require.Nil(t, err)
+	verified, err = VerifySignature(digest, headers.Signatures[addr])
+	require.Nil(t, err)
+	assert.True(t, verified)
+}
+
+func TestSignBlockWithBLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := blsSuite.G2().Scalar().Pick(random.New())
+
+	block := &BlockWithHeaders{
+		Block: Block{
+			Transactions: []*transactions.Transaction{},
+		},
+	}
+
+	signed, err := SignBlockWithBLS(ctx, block, key)
+	require.Nil(t, err)
+
+	headers, err := signed.GetStandardHeaders()
+	require.Nil(t, err)
+	require.Len(t, headers.Signatures, 1)
+
+	digest, err := BlockDigest(&signed.Block)
+	require.Nil(t, err)
+	for _, sig := range headers.Signatures {
+		assert.Equal(t, signatures.PublicKey_KeyTypeBLSGroupSig, sig.Ownership.PublicKey.Type)
+		verified, err := VerifySignature(digest, sig)
+		require.Nil(t, err)
+		assert.True(t, verified)
+
+		otherDigest, err := BlockDigest(&Block{Height: 1})
+		require.Nil(t, err)
+		verified, err = VerifySignature(otherDigest, sig)
+		require.Nil(t, err)
+		assert.False(t, verified)
+	}
+}
+
+func TestSignatureValidator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	owner, err := crypto.GenerateKey()
+	require.Nil(t, err)
+	other, err := crypto.GenerateKey()
+	require.Nil(t, err)
+	blsOwner := blsSuite.G2().Scalar().Pick(random.New())
+
+	ct := newEmptyChainTree(t, ctx, DIDPrefix+crypto.PubkeyToAddress(owner.PublicKey).String())
+	ct.BlockValidators = []BlockValidatorFunc{SignatureValidator}
+
+	newBlock := func(txn *transactions.Transaction) *BlockWithHeaders {
+		block := &BlockWithHeaders{
+			Block: Block{
+				Transactions: []*transactions.Transaction{txn},
+			},
+		}
+		if hasChain(ctx, ct) {
+			height, _, _ := ct.Dag.Resolve(ctx, []string{"height"})
+			block.Height = uint64(height.(int)) + 1
+			block.PreviousTip = &ct.Dag.Tip
+		}
+		return block
+	}
+
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+
+	t.Run("unsigned blocks are rejected", func(t *testing.T) {
+		valid, err := ct.ProcessBlock(ctx, newBlock(txn))
+		require.False(t, valid)
+		require.NotNil(t, err)
+		assert.Equal(t, ErrInvalidSignature, err.(CodedError).GetCode())
+	})
+
+	t.Run("blocks signed by a non-owner are rejected", func(t *testing.T) {
+		signed, err := SignBlock(ctx, newBlock(txn), other)
+		require.Nil(t, err)
+		valid, err := ct.ProcessBlock(ctx, signed)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("tampered blocks are rejected", func(t *testing.T) {
+		signed, err := SignBlock(ctx, newBlock(txn), owner)
+		require.Nil(t, err)
+		signed.Height = signed.Height + 10
+		valid, err := ct.ProcessBlock(ctx, signed)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("the genesis owner can sign", func(t *testing.T) {
+		signed, err := SignBlock(ctx, newBlock(txn), owner)
+		require.Nil(t, err)
+		valid, err := ct.ProcessBlock(ctx, signed)
+		require.Nil(t, err)
+		require.True(t, valid)
+	})
+
+	blsAddr, err := PublicKeyToAddress(&signatures.PublicKey{
+		Type:      signatures.PublicKey_KeyTypeBLSGroupSig,
+		PublicKey: mustMarshal(t, blsSuite.G2().Point().Mul(blsOwner, nil)),
+	})
+	require.Nil(t, err)
+
+	t.Run("ownership can be transferred", func(t *testing.T) {
+		setOwnership, err := NewSetOwnershipTransaction([]string{blsAddr})
+		require.Nil(t, err)
+		signed, err := SignBlock(ctx, newBlock(setOwnership), owner)
+		require.Nil(t, err)
+		valid, err := ct.ProcessBlock(ctx, signed)
+		require.Nil(t, err)
+		require.True(t, valid)
+
+		signed, err = SignBlock(ctx, newBlock(txn), owner)
+		require.Nil(t, err)
+		valid, err = ct.ProcessBlock(ctx, signed)
+		require.False(t, valid)
+		require.NotNil(t, err)
+
+		signed, err = SignBlockWithBLS(ctx, newBlock(txn), blsOwner)
+		require.Nil(t, err)
+		valid, err = ct.ProcessBlock(ctx, signed)
+		require.Nil(t, err)
+		require.True(t, valid)
+	})
+}
+
+func mustMarshal(t *testing.T, m interface{ MarshalBinary() ([]byte, error) }) []byte {
+	bits, err := m.MarshalBinary()
+	require.Nil(t, err)
+	return bits
+}
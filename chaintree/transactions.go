@@ -31,6 +31,12 @@ func NewSetDataTransaction(path string, value interface{}) (*transactions.Transa
 	return NewSetDataBytesTransaction(path, valBytes)
 }
 
+// NewSetDataTransactionAtPath is NewSetDataTransaction for a path of keys, which may
+// contain any characters
+func NewSetDataTransactionAtPath(path Path, value interface{}) (*transactions.Transaction, error) {
+	return NewSetDataTransaction(path.String(), value)
+}
+
 func NewSetDataBytesTransaction(path string, data []byte) (*transactions.Transaction, error) {
 	payload := &transactions.SetDataPayload{
 		Path:  path,
@@ -0,0 +1,452 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/quorumcontrol/chaintree/typecaster"
+)
+
+const (
+	// TupeloLabel is the reserved top-level key of the tree which only the
+	// built-in transactors may write to.
+	TupeloLabel = "_tupelo"
+
+	AuthenticationsLabel = "authentications"
+	TokensLabel          = "tokens"
+
+	TokenMonetaryPolicyLabel = "monetaryPolicy"
+	TokenBalanceLabel        = "balance"
+	TokenMintedLabel         = "minted"
+	TokenSendsLabel          = "sends"
+	TokenReceivesLabel       = "receives"
+)
+
+var (
+	// TreePathForAuthentications is where SETOWNERSHIP stores the owner addresses (relative to the tree)
+	TreePathForAuthentications = Path{TupeloLabel, AuthenticationsLabel}
+	// TreePathForTokens is where the token ledgers are stored (relative to the tree)
+	TreePathForTokens = Path{TupeloLabel, TokensLabel}
+)
+
+func init() {
+	cbornode.RegisterCborType(Token{})
+	cbornode.RegisterCborType(TokenSend{})
+	cbornode.RegisterCborType(TokenReceive{})
+
+	typecaster.AddType(Token{})
+	typecaster.AddType(TokenSend{})
+	typecaster.AddType(TokenReceive{})
+}
+
+// Token is the ledger of a single token kept at TreePathForTokens/<canonical name>
+type Token struct {
+	MonetaryPolicy *cid.Cid `refmt:"monetaryPolicy,omitempty" json:"monetaryPolicy,omitempty" cbor:"monetaryPolicy,omitempty"`
+	Balance        uint64   `refmt:"balance" json:"balance" cbor:"balance"`
+	Minted         uint64   `refmt:"minted" json:"minted" cbor:"minted"`
+	Sends          *cid.Cid `refmt:"sends,omitempty" json:"sends,omitempty" cbor:"sends,omitempty"`
+	Receives       *cid.Cid `refmt:"receives,omitempty" json:"receives,omitempty" cbor:"receives,omitempty"`
+}
+
+// TokenSend is the record of a SENDTOKEN transaction kept in the sender's ledger
+type TokenSend struct {
+	Id          string `refmt:"id" json:"id" cbor:"id"`
+	Token       string `refmt:"token" json:"token" cbor:"token"`
+	Amount      uint64 `refmt:"amount" json:"amount" cbor:"amount"`
+	Destination string `refmt:"destination" json:"destination" cbor:"destination"`
+}
+
+// TokenReceive is the record of a RECEIVETOKEN transaction kept in the receiver's ledger
+type TokenReceive struct {
+	SendTokenTransactionId string  `refmt:"sendTokenTransactionId" json:"sendTokenTransactionId" cbor:"sendTokenTransactionId"`
+	Token                  string  `refmt:"token" json:"token" cbor:"token"`
+	Amount                 uint64  `refmt:"amount" json:"amount" cbor:"amount"`
+	Tip                    cid.Cid `refmt:"tip" json:"tip" cbor:"tip"`
+}
+
+// CanonicalTokenName returns the name a token is stored under in a ledger. Tokens are
+// namespaced by the DID of the chaintree which established them, so a bare name is
+// prefixed with chainTreeDID and an already canonical name (one starting with "did:")
+// is returned as is.
+func CanonicalTokenName(chainTreeDID, name string) string {
+	if strings.HasPrefix(name, "did:") {
+		return name
+	}
+	return chainTreeDID + ":" + name
+}
+
+// DefaultTransactors returns the reference TransactorFuncs for every transaction type
+// which has a constructor in this package. They can be passed straight to NewChainTree.
+// RECEIVETOKEN is left out since it can't be played safely without checking that the
+// send was accepted, add NewReceiveTokenTransactor with a SendVerifier for it.
+func DefaultTransactors() map[transactions.Transaction_Type]TransactorFunc {
+	return map[transactions.Transaction_Type]TransactorFunc{
+		transactions.Transaction_SETDATA:        SetDataTransactor,
+		transactions.Transaction_SETOWNERSHIP:   SetOwnershipTransactor,
+		transactions.Transaction_ESTABLISHTOKEN: EstablishTokenTransactor,
+		transactions.Transaction_MINTTOKEN:      MintTokenTransactor,
+		transactions.Transaction_SENDTOKEN:      SendTokenTransactor,
+	}
+}
+
+// SendVerifier checks that the tip of a sending chaintree in a RECEIVETOKEN payload was
+// really accepted (e.g. by checking payload.Proof against the signers of a notary group)
+// and returns an error when it wasn't
+type SendVerifier func(ctx context.Context, tip cid.Cid, payload *transactions.ReceiveTokenPayload) error
+
+func invalidTransaction(format string, args ...interface{}) CodedError {
+	return &ErrorCode{Code: ErrInvalidTransaction, Memo: fmt.Sprintf(format, args...)}
+}
+
+// SetDataTransactor sets the cbor encoded value of the payload at the payload's path
+// in the tree. Maps are stored as links, everything else inline. Paths under
+// TupeloLabel are reserved and rejected.
+func SetDataTransactor(_ string, tree *dag.Dag, transaction *transactions.Transaction) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureSetDataPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+
+	path, err := ParsePath(payload.Path)
+	if err == nil && len(path) == 0 {
+		err = fmt.Errorf("path must not be empty")
+	}
+	if err != nil {
+		return nil, false, invalidTransaction("error decoding path: %v", err)
+	}
+	if path[0] == TupeloLabel {
+		return nil, false, invalidTransaction("path %q is reserved", payload.Path)
+	}
+
+	var val interface{}
+	err = cbornode.DecodeInto(payload.Value, &val)
+	if err != nil {
+		return nil, false, invalidTransaction("error decoding data value: %v", err)
+	}
+
+	switch val.(type) {
+	case map[string]interface{}:
+		newTree, err = tree.SetAsLink(ctx, path, val)
+	default:
+		newTree, err = tree.Set(ctx, path, val)
+	}
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+// SetOwnershipTransactor replaces the list of addresses at TreePathForAuthentications
+func SetOwnershipTransactor(_ string, tree *dag.Dag, transaction *transactions.Transaction) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureSetOwnershipPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+	if len(payload.Authentication) == 0 {
+		return nil, false, invalidTransaction("ownership must have at least one authentication")
+	}
+
+	newTree, err = tree.SetAsLink(ctx, TreePathForAuthentications, payload.Authentication)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+// EstablishTokenTransactor creates an empty ledger with the payload's monetary policy
+func EstablishTokenTransactor(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureEstablishTokenPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+	if payload.Name == "" {
+		return nil, false, invalidTransaction("token must have a name")
+	}
+
+	name := CanonicalTokenName(chainTreeDID, payload.Name)
+	if !strings.HasPrefix(name, chainTreeDID+":") {
+		return nil, false, invalidTransaction("can not establish token %s owned by another chaintree", name)
+	}
+
+	tokenPath := append(copyPath(TreePathForTokens), name)
+	existing, _, err := tree.Resolve(ctx, tokenPath)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error resolving token: %v", err)}
+	}
+	if existing != nil {
+		return nil, false, invalidTransaction("token %s already exists", name)
+	}
+
+	policy := payload.MonetaryPolicy
+	if policy == nil {
+		policy = &transactions.TokenMonetaryPolicy{}
+	}
+
+	newTree, err = tree.SetAsLink(ctx, tokenPath, &Token{})
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating token: %v", err)}
+	}
+	newTree, err = newTree.SetAsLink(ctx, append(copyPath(tokenPath), TokenMonetaryPolicyLabel), policy)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting monetary policy: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+// MintTokenTransactor adds to the balance of a token established by this chaintree,
+// never minting more in total than the monetary policy's maximum (0 means unlimited).
+func MintTokenTransactor(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureMintTokenPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+	if payload.Amount == 0 {
+		return nil, false, invalidTransaction("must mint a positive amount")
+	}
+
+	name := CanonicalTokenName(chainTreeDID, payload.Name)
+	tokenPath := append(copyPath(TreePathForTokens), name)
+	token, codedErr := getToken(ctx, tree, tokenPath)
+	if codedErr != nil {
+		return nil, false, codedErr
+	}
+	if token.MonetaryPolicy == nil {
+		return nil, false, invalidTransaction("token %s can not be minted by this chaintree", name)
+	}
+
+	policy := &transactions.TokenMonetaryPolicy{}
+	err = tree.ResolveInto(ctx, append(copyPath(tokenPath), TokenMonetaryPolicyLabel), policy)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting monetary policy: %v", err)}
+	}
+
+	minted := token.Minted + payload.Amount
+	if minted < token.Minted || (policy.Maximum > 0 && minted > policy.Maximum) {
+		return nil, false, invalidTransaction("minting %d of %s would exceed the maximum of %d", payload.Amount, name, policy.Maximum)
+	}
+
+	newTree, err = tree.Set(ctx, append(copyPath(tokenPath), TokenMintedLabel), minted)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting minted: %v", err)}
+	}
+	newTree, err = newTree.Set(ctx, append(copyPath(tokenPath), TokenBalanceLabel), token.Balance+payload.Amount)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting balance: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+// SendTokenTransactor debits the ledger and records a TokenSend under the payload's
+// id, which the destination chaintree later proves in a RECEIVETOKEN transaction.
+func SendTokenTransactor(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureSendTokenPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+	if payload.Id == "" {
+		return nil, false, invalidTransaction("send must have an id")
+	}
+	if payload.Amount == 0 {
+		return nil, false, invalidTransaction("must send a positive amount")
+	}
+	if payload.Destination == "" || payload.Destination == chainTreeDID {
+		return nil, false, invalidTransaction("invalid destination: %q", payload.Destination)
+	}
+
+	name := CanonicalTokenName(chainTreeDID, payload.Name)
+	tokenPath := append(copyPath(TreePathForTokens), name)
+	token, codedErr := getToken(ctx, tree, tokenPath)
+	if codedErr != nil {
+		return nil, false, codedErr
+	}
+	if token.Balance < payload.Amount {
+		return nil, false, invalidTransaction("cannot send %d of %s, balance is %d", payload.Amount, name, token.Balance)
+	}
+
+	sendPath := append(copyPath(tokenPath), TokenSendsLabel, payload.Id)
+	existing, _, err := tree.Resolve(ctx, sendPath)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error resolving send: %v", err)}
+	}
+	if existing != nil {
+		return nil, false, invalidTransaction("send %s already exists", payload.Id)
+	}
+
+	send := &TokenSend{
+		Id:          payload.Id,
+		Token:       name,
+		Amount:      payload.Amount,
+		Destination: payload.Destination,
+	}
+	newTree, err = tree.SetAsLink(ctx, sendPath, send)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting send: %v", err)}
+	}
+	newTree, err = newTree.Set(ctx, append(copyPath(tokenPath), TokenBalanceLabel), token.Balance-payload.Amount)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting balance: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+// NewReceiveTokenTransactor returns a TransactorFunc which credits the ledger with a
+// TokenSend from another chaintree. The payload's leaves must contain the nodes of the
+// sending chaintree from its root (which must hash to the payload's tip) down to the
+// TokenSend, the last leaf, and verify must accept the tip. A nil verify rejects every
+// receive.
+func NewReceiveTokenTransactor(verify SendVerifier) TransactorFunc {
+	return func(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction) (*dag.Dag, bool, CodedError) {
+		return receiveToken(chainTreeDID, tree, transaction, verify)
+	}
+}
+
+func receiveToken(chainTreeDID string, tree *dag.Dag, transaction *transactions.Transaction, verify SendVerifier) (newTree *dag.Dag, valid bool, codedErr CodedError) {
+	ctx := context.TODO()
+
+	payload, err := transaction.EnsureReceiveTokenPayload()
+	if err != nil || payload == nil {
+		return nil, false, invalidTransaction("error getting payload: %v", err)
+	}
+	if len(payload.Leaves) == 0 {
+		return nil, false, invalidTransaction("receive must include leaves")
+	}
+
+	tip, err := cid.Cast(payload.Tip)
+	if err != nil {
+		return nil, false, invalidTransaction("error casting tip: %v", err)
+	}
+	if verify == nil {
+		return nil, false, invalidTransaction("receives can not be verified")
+	}
+	err = verify(ctx, tip, payload)
+	if err != nil {
+		return nil, false, invalidTransaction("error verifying send: %v", err)
+	}
+
+	sw := &safewrap.SafeWrap{}
+	nodes := make([]format.Node, len(payload.Leaves))
+	for i, leaf := range payload.Leaves {
+		nodes[i] = sw.Decode(leaf)
+	}
+	if sw.Err != nil {
+		return nil, false, invalidTransaction("error decoding leaves: %v", sw.Err)
+	}
+	if !nodes[0].Cid().Equals(tip) {
+		return nil, false, invalidTransaction("first leaf %s does not match tip %s", nodes[0].Cid(), tip)
+	}
+
+	claimed := &TokenSend{}
+	err = cbornode.DecodeInto(nodes[len(nodes)-1].RawData(), claimed)
+	if err != nil {
+		return nil, false, invalidTransaction("error decoding send: %v", err)
+	}
+	if claimed.Id != payload.SendTokenTransactionId {
+		return nil, false, invalidTransaction("send id %q does not match %q", claimed.Id, payload.SendTokenTransactionId)
+	}
+	if claimed.Destination != chainTreeDID {
+		return nil, false, invalidTransaction("send destination %q does not match %q", claimed.Destination, chainTreeDID)
+	}
+
+	// make sure the send is actually in the sending ledger at the tip
+	senderStore, err := nodestore.MemoryStore(ctx)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating store: %v", err)}
+	}
+	senderDag, err := dag.NewDagWithNodes(ctx, senderStore, nodes...)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error creating sender dag: %v", err)}
+	}
+	sendPath := append(Path{TreeLabel}, TreePathForTokens...)
+	sendPath = append(sendPath, claimed.Token, TokenSendsLabel, claimed.Id)
+	send := &TokenSend{}
+	err = senderDag.ResolveInto(ctx, sendPath, send)
+	if err != nil {
+		return nil, false, invalidTransaction("error resolving send in leaves: %v", err)
+	}
+	if *send != *claimed {
+		return nil, false, invalidTransaction("send in leaves does not match the sending ledger")
+	}
+
+	tokenPath := append(copyPath(TreePathForTokens), send.Token)
+	receivePath := append(copyPath(tokenPath), TokenReceivesLabel, send.Id)
+	existing, _, err := tree.Resolve(ctx, receivePath)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error resolving receive: %v", err)}
+	}
+	if existing != nil {
+		return nil, false, invalidTransaction("send %s has already been received", send.Id)
+	}
+
+	var balance uint64
+	existing, _, err = tree.Resolve(ctx, tokenPath)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error resolving token: %v", err)}
+	}
+	if existing != nil {
+		token, codedErr := getToken(ctx, tree, tokenPath)
+		if codedErr != nil {
+			return nil, false, codedErr
+		}
+		balance = token.Balance
+	}
+	if balance+send.Amount < balance {
+		return nil, false, invalidTransaction("receiving %d of %s would overflow the balance", send.Amount, send.Token)
+	}
+
+	receive := &TokenReceive{
+		SendTokenTransactionId: send.Id,
+		Token:                  send.Token,
+		Amount:                 send.Amount,
+		Tip:                    tip,
+	}
+	newTree, err = tree.SetAsLink(ctx, receivePath, receive)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting receive: %v", err)}
+	}
+	newTree, err = newTree.Set(ctx, append(copyPath(tokenPath), TokenBalanceLabel), balance+send.Amount)
+	if err != nil {
+		return nil, false, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error setting balance: %v", err)}
+	}
+
+	return newTree, true, nil
+}
+
+func getToken(ctx context.Context, tree *dag.Dag, tokenPath Path) (*Token, CodedError) {
+	token := &Token{}
+	err := tree.ResolveInto(ctx, tokenPath, token)
+	if err == format.ErrNotFound {
+		return nil, invalidTransaction("token %s does not exist", tokenPath[len(tokenPath)-1])
+	}
+	if err != nil {
+		return nil, &ErrorCode{Code: ErrUnknown, Memo: fmt.Sprintf("error getting token: %v", err)}
+	}
+	return token, nil
+}
+
+func copyPath(path Path) Path {
+	return append(Path{}, path...)
+}
@@ -0,0 +1,282 @@
+package chaintree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func newEmptyChainTree(t *testing.T, ctx context.Context, id string) *ChainTree {
+	sw := &safewrap.SafeWrap{}
+	treeNode := sw.WrapObject(make(map[string]string))
+	chainNode := sw.WrapObject(make(map[string]string))
+	root := sw.WrapObject(map[string]interface{}{
+		"chain": chainNode.Cid(),
+		"tree":  treeNode.Cid(),
+		"id":    id,
+	})
+	require.Nil(t, sw.Err)
+
+	store := nodestore.MustMemoryStore(ctx)
+	d, err := dag.NewDagWithNodes(ctx, store, root, treeNode, chainNode)
+	require.Nil(t, err)
+
+	ct, err := NewChainTree(ctx, d, nil, DefaultTransactors())
+	require.Nil(t, err)
+	return ct
+}
+
+func processTransactions(ctx context.Context, ct *ChainTree, txns ...*transactions.Transaction) (bool, error) {
+	block := &BlockWithHeaders{
+		Block: Block{
+			Transactions: txns,
+		},
+	}
+	if hasChain(ctx, ct) {
+		height, _, _ := ct.Dag.Resolve(ctx, []string{"height"})
+		block.Height = uint64(height.(int)) + 1
+		block.PreviousTip = &ct.Dag.Tip
+	}
+	return ct.ProcessBlock(ctx, block)
+}
+
+func hasChain(ctx context.Context, ct *ChainTree) bool {
+	end, _, _ := ct.Dag.Resolve(ctx, []string{ChainLabel, ChainEndLabel})
+	return end != nil
+}
+
+func TestSetDataTransactor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+
+	txn, err := NewSetDataTransaction("down/in/the/thing", "hi")
+	require.Nil(t, err)
+	mapTxn, err := NewSetDataTransaction("/some/map", map[string]interface{}{"a": "b"})
+	require.Nil(t, err)
+
+	valid, err := processTransactions(ctx, ct, txn, mapTxn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	val, _, err := ct.Dag.Resolve(ctx, []string{TreeLabel, "down", "in", "the", "thing"})
+	require.Nil(t, err)
+	assert.Equal(t, "hi", val)
+
+	val, _, err = ct.Dag.Resolve(ctx, []string{TreeLabel, "some", "map", "a"})
+	require.Nil(t, err)
+	assert.Equal(t, "b", val)
+
+	t.Run("rejects reserved paths", func(t *testing.T) {
+		txn, err := NewSetDataTransaction("_tupelo/authentications", []string{"bad"})
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.False(t, valid)
+		require.NotNil(t, err)
+		assert.Equal(t, ErrInvalidTransaction, err.(CodedError).GetCode())
+	})
+
+	t.Run("rejects empty path segments", func(t *testing.T) {
+		txn, err := NewSetDataTransaction("down//thing", "hi")
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("rejects invalid escapes", func(t *testing.T) {
+		txn, err := NewSetDataTransaction(`down\xin`, "hi")
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("sets keys containing slashes", func(t *testing.T) {
+		path := Path{"urls", "https://example.com/a", `back\slash`}
+		assert.Equal(t, `urls/https:\/\/example.com\/a/back\\slash`, path.String())
+
+		txn, err := NewSetDataTransactionAtPath(path, "escaped")
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, ct, txn)
+		require.Nil(t, err)
+		require.True(t, valid)
+
+		val, _, err := ct.Dag.Resolve(ctx, append(Path{TreeLabel}, path...))
+		require.Nil(t, err)
+		assert.Equal(t, "escaped", val)
+	})
+}
+
+func TestSetOwnershipTransactor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newEmptyChainTree(t, ctx, "did:tupelo:test")
+
+	txn, err := NewSetOwnershipTransaction([]string{"0xabc", "0xdef"})
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, ct, txn)
+	require.Nil(t, err)
+	require.True(t, valid)
+
+	auths, _, err := ct.Dag.Resolve(ctx, append(Path{TreeLabel}, TreePathForAuthentications...))
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"0xabc", "0xdef"}, auths)
+
+	txn, err = NewSetOwnershipTransaction([]string{})
+	require.Nil(t, err)
+	valid, err = processTransactions(ctx, ct, txn)
+	require.False(t, valid)
+	require.NotNil(t, err)
+}
+
+func TestTokenTransactors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	senderDID := "did:tupelo:sender"
+	receiverDID := "did:tupelo:receiver"
+	sender := newEmptyChainTree(t, ctx, senderDID)
+	tokenName := CanonicalTokenName(senderDID, "coin")
+
+	// only accept sends from the tip of sender the test knows about
+	var acceptedTip cid.Cid
+	verify := func(_ context.Context, tip cid.Cid, _ *transactions.ReceiveTokenPayload) error {
+		if !tip.Equals(acceptedTip) {
+			return fmt.Errorf("unknown tip %s", tip)
+		}
+		return nil
+	}
+	newReceiver := func(did string) *ChainTree {
+		ct := newEmptyChainTree(t, ctx, did)
+		ct.Transactors[transactions.Transaction_RECEIVETOKEN] = NewReceiveTokenTransactor(verify)
+		return ct
+	}
+	receiver := newReceiver(receiverDID)
+
+	getToken := func(ct *ChainTree) *Token {
+		tree, err := ct.Tree(ctx)
+		require.Nil(t, err)
+		token := &Token{}
+		err = tree.ResolveInto(ctx, append(copyPath(TreePathForTokens), tokenName), token)
+		require.Nil(t, err)
+		return token
+	}
+
+	establish, err := NewEstablishTokenTransaction("coin", 100)
+	require.Nil(t, err)
+	mint, err := NewMintTokenTransaction("coin", 60)
+	require.Nil(t, err)
+	valid, err := processTransactions(ctx, sender, establish, mint)
+	require.Nil(t, err)
+	require.True(t, valid)
+	assert.Equal(t, uint64(60), getToken(sender).Balance)
+
+	t.Run("cannot establish twice", func(t *testing.T) {
+		valid, err := processTransactions(ctx, sender, establish)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("cannot mint past the maximum", func(t *testing.T) {
+		mint, err := NewMintTokenTransaction("coin", 41)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, sender, mint)
+		require.False(t, valid)
+		require.NotNil(t, err)
+		assert.Equal(t, ErrInvalidTransaction, err.(CodedError).GetCode())
+	})
+
+	t.Run("cannot overdraw", func(t *testing.T) {
+		send, err := NewSendTokenTransaction("overdraw", "coin", 61, receiverDID)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, sender, send)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	send, err := NewSendTokenTransaction("send1", "coin", 25, receiverDID)
+	require.Nil(t, err)
+	valid, err = processTransactions(ctx, sender, send)
+	require.Nil(t, err)
+	require.True(t, valid)
+	assert.Equal(t, uint64(35), getToken(sender).Balance)
+
+	t.Run("cannot reuse a send id", func(t *testing.T) {
+		valid, err := processTransactions(ctx, sender, send)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	sendPath := append(Path{TreeLabel}, TreePathForTokens...)
+	sendPath = append(sendPath, tokenName, TokenSendsLabel, "send1")
+	nodes, err := sender.Dag.NodesForPath(ctx, sendPath)
+	require.Nil(t, err)
+	leaves := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		leaves[i] = n.RawData()
+	}
+
+	receive, err := NewReceiveTokenTransaction("send1", sender.Dag.Tip.Bytes(), nil, leaves)
+	require.Nil(t, err)
+
+	t.Run("cannot receive an unverified send", func(t *testing.T) {
+		valid, err := processTransactions(ctx, receiver, receive)
+		require.False(t, valid)
+		require.NotNil(t, err)
+
+		defaults := newEmptyChainTree(t, ctx, receiverDID)
+		valid, err = processTransactions(ctx, defaults, receive)
+		require.False(t, valid)
+		require.NotNil(t, err)
+		assert.Equal(t, ErrUnknownTransactionType, err.(CodedError).GetCode())
+	})
+
+	acceptedTip = sender.Dag.Tip
+	valid, err = processTransactions(ctx, receiver, receive)
+	require.Nil(t, err)
+	require.True(t, valid)
+	token := getToken(receiver)
+	assert.Equal(t, uint64(25), token.Balance)
+	assert.Nil(t, token.MonetaryPolicy)
+
+	t.Run("cannot receive twice", func(t *testing.T) {
+		valid, err := processTransactions(ctx, receiver, receive)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("cannot receive a send to someone else", func(t *testing.T) {
+		other := newReceiver("did:tupelo:other")
+		valid, err := processTransactions(ctx, other, receive)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("cannot receive with mismatched leaves", func(t *testing.T) {
+		receive, err := NewReceiveTokenTransaction("send1", sender.Dag.Tip.Bytes(), nil, leaves[1:])
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, newReceiver(receiverDID), receive)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+
+	t.Run("cannot mint a received token", func(t *testing.T) {
+		mint, err := NewMintTokenTransaction(tokenName, 1)
+		require.Nil(t, err)
+		valid, err := processTransactions(ctx, receiver, mint)
+		require.False(t, valid)
+		require.NotNil(t, err)
+	})
+}
@@ -0,0 +1,400 @@
+// Command chaintree inspects and manipulates chaintrees kept in a local on-disk datastore.
+//
+//	chaintree [-store dir] <command> [arguments]
+//
+// Run chaintree without arguments for the list of commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/messages/v2/build/go/transactions"
+
+	"github.com/quorumcontrol/chaintree/chaintree"
+	"github.com/quorumcontrol/chaintree/dag"
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+const usage = `usage: chaintree [-store dir] <command> [arguments]
+
+commands:
+  new <did>                       create an empty chaintree and print its tip
+  resolve <tip> <path>            print the value at path (from the root, e.g. tree/some/key)
+  dump [-links] <tip> [path]      print the tree (or a path in it) as JSON
+  history <tip>                   list the blocks in the chain, newest first
+  verify [-signatures] <tip>      check every node hash and replay the chain
+                                  (from the empty tree new creates, see below)
+  set <tip> <path> <json>         set data in the tree with a locally played block
+  export <tip> <file>             write a CAR snapshot of the chaintree
+  import <file>                   read a CAR snapshot and print its root
+
+Blocks are played (by set) and replayed (by verify) with the default transactors only,
+so chains with other transactions (e.g. RECEIVETOKEN, which needs a verifier for the
+sending chain) can not be verified.
+`
+
+type command func(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error
+
+var commands = map[string]command{
+	"new":     newCommand,
+	"resolve": resolveCommand,
+	"dump":    dumpCommand,
+	"history": historyCommand,
+	"verify":  verifyCommand,
+	"set":     setCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+}
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("chaintree", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	storePath := flags.String("store", "./chaintree-data", "directory of the datastore")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New(usage)
+	}
+
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", flags.Arg(0), usage)
+	}
+
+	store, err := nodestore.Badger(*storePath, nil)
+	if err != nil {
+		return fmt.Errorf("error opening store: %v", err)
+	}
+	defer store.Close()
+
+	return cmd(ctx, store, flags.Args()[1:], out)
+}
+
+func newCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: new <did>")
+	}
+
+	nodes, err := emptyTree(args[0])
+	if err != nil {
+		return err
+	}
+	err = store.AddMany(ctx, nodes)
+	if err != nil {
+		return fmt.Errorf("error adding nodes: %v", err)
+	}
+	fmt.Fprintln(out, nodes[0].Cid().String())
+	return nil
+}
+
+// emptyTree returns the nodes of a new chaintree with the given id, root first
+func emptyTree(id string) ([]format.Node, error) {
+	sw := &safewrap.SafeWrap{}
+	treeNode := sw.WrapObject(make(map[string]string))
+	chainNode := sw.WrapObject(make(map[string]string))
+	root := sw.WrapObject(map[string]interface{}{
+		chaintree.ChainLabel: chainNode.Cid(),
+		chaintree.TreeLabel:  treeNode.Cid(),
+		"id":                 id,
+	})
+	if sw.Err != nil {
+		return nil, fmt.Errorf("error creating nodes: %v", sw.Err)
+	}
+	return []format.Node{root, treeNode, chainNode}, nil
+}
+
+func resolveCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: resolve <tip> <path>")
+	}
+	ct, err := openChainTree(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+
+	path, err := chaintree.ParsePath(args[1])
+	if err != nil {
+		return err
+	}
+	val, err := ct.Dag.ExportJSON(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(val))
+	return nil
+}
+
+func dumpCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	links := flags.Bool("links", false, "write links as {\"/\": cid} instead of inlining them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: dump [-links] <tip> [path]")
+	}
+
+	ct, err := openChainTree(ctx, store, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	tree, err := ct.Tree(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting tree: %v", err)
+	}
+
+	path, err := chaintree.ParsePath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	val, err := tree.ExportJSON(ctx, path, !*links)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(val))
+	return nil
+}
+
+func historyCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: history <tip>")
+	}
+	ct, err := openChainTree(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+
+	iter, err := ct.Blocks(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting blocks: %v", err)
+	}
+	for iter.Next() {
+		block := iter.Block()
+		var types []string
+		for _, txn := range block.Transactions {
+			types = append(types, txn.Type.String())
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\n", block.Height, iter.Cid().String(), strings.Join(types, ","))
+	}
+	return iter.Err()
+}
+
+func verifyCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	checkSignatures := flags.Bool("signatures", false, "require valid signatures on every replayed block")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify [-signatures] <tip>")
+	}
+	ct, err := openChainTree(ctx, store, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *checkSignatures {
+		ct.BlockValidators = []chaintree.BlockValidatorFunc{chaintree.SignatureValidator}
+	}
+
+	count := 0
+	seen := make(map[cid.Cid]struct{})
+	err = ct.Dag.Walk(ctx, func(_ []string, n format.Node) error {
+		if _, ok := seen[n.Cid()]; ok {
+			return dag.SkipNode
+		}
+		seen[n.Cid()] = struct{}{}
+		sum, err := n.Cid().Prefix().Sum(n.RawData())
+		if err != nil || !sum.Equals(n.Cid()) {
+			return fmt.Errorf("node %s does not match its hash", n.Cid().String())
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d nodes ok\n", count)
+
+	// replay every block on top of the tip before it, the genesis block is replayed on
+	// top of the empty tree new creates with the same id
+	id, err := ct.Id(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting id: %v", err)
+	}
+	after := ct.Dag.Tip
+	iter, err := ct.Blocks(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting blocks: %v", err)
+	}
+	for iter.Next() {
+		block := iter.Block()
+		var before *chaintree.ChainTree
+		if block.PreviousTip == nil {
+			before, err = emptyChainTree(ctx, ct, id)
+			if err != nil {
+				return err
+			}
+		} else {
+			before, err = ct.At(ctx, block.PreviousTip)
+			if err != nil {
+				return fmt.Errorf("error getting tip %s: %v", block.PreviousTip.String(), err)
+			}
+		}
+		// simulated so verifying never writes to the store being verified
+		simulation, valid, err := before.SimulateBlock(ctx, block)
+		if coded, ok := err.(chaintree.CodedError); ok && coded.GetCode() == chaintree.ErrUnknownTransactionType {
+			return fmt.Errorf("block %d can not be replayed with the default transactors: %v", block.Height, err)
+		}
+		if err != nil || !valid {
+			return fmt.Errorf("block %d is invalid: %v", block.Height, err)
+		}
+		if !simulation.Tip.Equals(after) {
+			if block.PreviousTip == nil {
+				return fmt.Errorf("block %d results in %s instead of %s, the chaintree did not start as the empty tree for %s", block.Height, simulation.Tip.String(), after.String(), id)
+			}
+			return fmt.Errorf("block %d results in %s instead of %s", block.Height, simulation.Tip.String(), after.String())
+		}
+		fmt.Fprintf(out, "block %d ok\n", block.Height)
+		if block.PreviousTip != nil {
+			after = *block.PreviousTip
+		}
+	}
+	return iter.Err()
+}
+
+// emptyChainTree returns the empty tree new creates for id as a ChainTree set up like ct,
+// its nodes are only held in memory on top of ct's store
+func emptyChainTree(ctx context.Context, ct *chaintree.ChainTree, id string) (*chaintree.ChainTree, error) {
+	nodes, err := emptyTree(id)
+	if err != nil {
+		return nil, err
+	}
+	overlay := nodestore.NewOverlay(ct.Dag.Store)
+	if err := overlay.AddMany(ctx, nodes); err != nil {
+		return nil, fmt.Errorf("error adding nodes: %v", err)
+	}
+	empty, err := chaintree.NewChainTree(ctx, dag.NewDag(ctx, nodes[0].Cid(), overlay), ct.BlockValidators, ct.Transactors)
+	if err != nil {
+		return nil, fmt.Errorf("error creating chaintree: %v", err)
+	}
+	return empty, nil
+}
+
+func setCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: set <tip> <path> <json>")
+	}
+	ct, err := openChainTree(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+
+	// anything which isn't JSON is taken as a plain string
+	var value interface{} = args[2]
+	if json.Valid([]byte(args[2])) {
+		var err error
+		value, err = dag.DecodeJSON([]byte(args[2]))
+		if err != nil {
+			return err
+		}
+	}
+	txn, err := chaintree.NewSetDataTransaction(args[1], value)
+	if err != nil {
+		return fmt.Errorf("error creating transaction: %v", err)
+	}
+
+	block := &chaintree.BlockWithHeaders{
+		Block: chaintree.Block{
+			Transactions: []*transactions.Transaction{txn},
+		},
+	}
+	iter, err := ct.Blocks(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting blocks: %v", err)
+	}
+	if iter.Next() {
+		block.Height = iter.Block().Height + 1
+		tip := ct.Dag.Tip
+		block.PreviousTip = &tip
+	}
+
+	valid, err := ct.ProcessBlock(ctx, block)
+	if err != nil || !valid {
+		return fmt.Errorf("error processing block (valid: %v): %v", valid, err)
+	}
+	fmt.Fprintln(out, ct.Dag.Tip.String())
+	return nil
+}
+
+func exportCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: export <tip> <file>")
+	}
+	ct, err := openChainTree(ctx, store, args[0])
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(args[1])
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	err = ct.ExportCAR(ctx, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importCommand(ctx context.Context, store nodestore.DagStore, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import <file>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	root, err := dag.ImportCAR(ctx, store, f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, root.String())
+	return nil
+}
+
+func openChainTree(ctx context.Context, store nodestore.DagStore, tip string) (*chaintree.ChainTree, error) {
+	id, err := cid.Decode(tip)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding tip %s: %v", tip, err)
+	}
+	if _, err := store.Get(ctx, id); err != nil {
+		return nil, fmt.Errorf("error getting tip %s: %v", tip, err)
+	}
+	ct, err := chaintree.NewChainTree(ctx, dag.NewDag(ctx, id, store), nil, chaintree.DefaultTransactors())
+	if err != nil {
+		return nil, fmt.Errorf("error creating chaintree: %v", err)
+	}
+	return ct, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/chaintree"
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "chaintree-cli")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storeDir := filepath.Join(dir, "store")
+	exec := func(args ...string) string {
+		out := &bytes.Buffer{}
+		err := run(ctx, append([]string{"-store", storeDir}, args...), out)
+		require.Nil(t, err, "args: %v", args)
+		return strings.TrimSpace(out.String())
+	}
+
+	tip := exec("new", "did:tupelo:test")
+	tip = exec("set", tip, "down/in/the/thing", `"hi"`)
+	tip = exec("set", tip, "other", `{"a": 1, "f": 1.0}`)
+
+	assert.Equal(t, `"hi"`, exec("resolve", tip, "tree/down/in/the/thing"))
+	assert.Equal(t, `{"down":{"in":{"the":{"thing":"hi"}}},"other":{"a":1,"f":1.0}}`, exec("dump", tip))
+	assert.Equal(t, `{"a":1,"f":1.0}`, exec("dump", tip, "other"))
+
+	history := strings.Split(exec("history", tip), "\n")
+	require.Len(t, history, 2)
+	assert.True(t, strings.HasPrefix(history[0], "1\t"))
+	assert.True(t, strings.HasSuffix(history[1], "SETDATA"))
+
+	verified := strings.Split(exec("verify", tip), "\n")
+	require.Len(t, verified, 3)
+	assert.True(t, strings.HasSuffix(verified[0], " nodes ok"))
+	assert.Equal(t, "block 1 ok", verified[1])
+	assert.Equal(t, "block 0 ok", verified[2])
+
+	snapshot := filepath.Join(dir, "snapshot.car")
+	exec("export", tip, snapshot)
+
+	storeDir = filepath.Join(dir, "other-store")
+	assert.Equal(t, tip, exec("import", snapshot))
+	assert.Equal(t, `"hi"`, exec("resolve", tip, "tree/down/in/the/thing"))
+
+	err = run(ctx, []string{"-store", storeDir, "nope"}, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
+
+// readOnlyStore fails every write
+type readOnlyStore struct {
+	nodestore.DagStore
+}
+
+func (s *readOnlyStore) Add(context.Context, format.Node) error {
+	return fmt.Errorf("store is read only")
+}
+
+func (s *readOnlyStore) AddMany(context.Context, []format.Node) error {
+	return fmt.Errorf("store is read only")
+}
+
+func TestVerifyDoesNotWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := nodestore.MustMemoryStore(ctx)
+	exec := func(store nodestore.DagStore, args ...string) string {
+		out := &bytes.Buffer{}
+		err := commands[args[0]](ctx, store, args[1:], out)
+		require.Nil(t, err, "args: %v", args)
+		return strings.TrimSpace(out.String())
+	}
+
+	tip := exec(store, "new", "did:tupelo:test")
+	tip = exec(store, "set", tip, "a", "1")
+	tip = exec(store, "set", tip, "b", "2")
+
+	verified := strings.Split(exec(&readOnlyStore{DagStore: store}, "verify", tip), "\n")
+	require.Len(t, verified, 3)
+	assert.Equal(t, "block 1 ok", verified[1])
+	assert.Equal(t, "block 0 ok", verified[2])
+}
+
+func TestVerifyReplaysGenesis(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := nodestore.MustMemoryStore(ctx)
+
+	// a chaintree which didn't start out empty
+	sw := &safewrap.SafeWrap{}
+	treeNode := sw.WrapObject(map[string]string{"already": "here"})
+	chainNode := sw.WrapObject(make(map[string]string))
+	root := sw.WrapObject(map[string]interface{}{
+		chaintree.ChainLabel: chainNode.Cid(),
+		chaintree.TreeLabel:  treeNode.Cid(),
+		"id":                 "did:tupelo:test",
+	})
+	require.Nil(t, sw.Err)
+	require.Nil(t, store.AddMany(ctx, []format.Node{root, treeNode, chainNode}))
+
+	out := &bytes.Buffer{}
+	require.Nil(t, setCommand(ctx, store, []string{root.Cid().String(), "a", "1"}, out))
+	tip := strings.TrimSpace(out.String())
+
+	err := verifyCommand(ctx, store, []string{tip}, &bytes.Buffer{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "did not start as the empty tree")
+}
@@ -0,0 +1,405 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+// Builder stages many sets and deletes against a Dag in memory and writes them all
+// at once on Commit. Nodes along the staged paths are loaded once and every changed
+// node (including each ancestor) is written exactly once, no matter how many changes
+// it saw, while nodes which were only read are never written. A Builder is not safe
+// for concurrent use.
+type Builder struct {
+	dag  *Dag
+	root *stagedNode
+}
+
+// stagedNode is a node which has been loaded (or created) and may be changed, the links
+// in obj are cid.Cids for untouched children and *stagedNodes for loaded ones. id is the
+// CID the node was loaded from (cid.Undef for new nodes) and dirty is set once obj
+// changes.
+type stagedNode struct {
+	obj   map[string]interface{}
+	id    cid.Cid
+	dirty bool
+}
+
+// stagedLink is a value set with SetAsLink, it becomes its own node on Commit
+type stagedLink struct {
+	val interface{}
+}
+
+// NewBuilder returns a Builder staging changes on top of d
+func (d *Dag) NewBuilder() *Builder {
+	return &Builder{dag: d}
+}
+
+// Set stages setting val at path, see Dag.Set
+func (b *Builder) Set(ctx context.Context, path []string, val interface{}) error {
+	if isComplexObj(val) {
+		return fmt.Errorf("can not set complex objects, use SetAsLink: %v", val)
+	}
+	return b.set(ctx, path, val)
+}
+
+// SetAsLink stages setting val as its own node linked at path, see Dag.SetAsLink
+func (b *Builder) SetAsLink(ctx context.Context, path []string, val interface{}) error {
+	return b.set(ctx, path, &stagedLink{val: val})
+}
+
+func (b *Builder) set(ctx context.Context, path []string, val interface{}) error {
+	if len(path) == 0 {
+		return fmt.Errorf("must pass in a key")
+	}
+	if link, ok := val.(*stagedLink); ok {
+		if err := checkReserved(path, link.val); err != nil {
+			return err
+		}
+	} else if err := checkReserved(path, val); err != nil {
+		return err
+	}
+	parent, _, touch, err := b.parent(ctx, path, true)
+	if err != nil {
+		return err
+	}
+	if err := setChild(ctx, parent, path[len(path)-1], val); err != nil {
+		return err
+	}
+	return touch()
+}
+
+// Delete stages removing the key at path, see Dag.Delete
+func (b *Builder) Delete(ctx context.Context, path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("can not delete the root of a dag, please supply a non-empty path")
+	}
+	parent, replaceParent, touch, err := b.parent(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	key := path[len(path)-1]
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := parent[key]; ok {
+			delete(parent, key)
+			return touch()
+		}
+	case []interface{}:
+		idx, err := listIndex(key, len(parent))
+		if err != nil {
+			return err
+		}
+		err = replaceParent(append(append([]interface{}{}, parent[:idx]...), parent[idx+1:]...))
+		if err != nil {
+			return err
+		}
+		return touch()
+	case *shard:
+		found, err := parent.delete(ctx, key)
+		if err != nil {
+			return err
+		}
+		if found {
+			return touch()
+		}
+	}
+	return fmt.Errorf("key %v does not exist at path %v", key, path[:len(path)-1])
+}
+
+// Commit writes every changed node in one batch and returns the Dag with the new tip.
+// The Builder carries on from the new tip afterwards.
+func (b *Builder) Commit(ctx context.Context) (*Dag, error) {
+	if b.root == nil {
+		return b.dag, nil
+	}
+
+	batch := format.NewBatch(ctx, b.dag.Store)
+	tip, changed, err := b.write(ctx, batch, b.root)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		b.root = nil
+		return b.dag, nil
+	}
+	err = batch.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing nodes: %v", err)
+	}
+
+	b.dag = b.dag.WithNewTip(tip.(cid.Cid))
+	b.root = nil
+	return b.dag, nil
+}
+
+// parent returns the (mutable) object, list or sharded map holding the last element of path, loading
+// nodes as needed, along with a function to replace that container in its own parent and one
+// which marks every node on the way to it as changed (to be called once the container is). With
+// create set missing or plain path elements are replaced with new nodes, otherwise a nil
+// container is returned for them.
+func (b *Builder) parent(ctx context.Context, path []string, create bool) (interface{}, func(interface{}) error, func() error, error) {
+	if b.root == nil {
+		loaded, err := b.load(ctx, b.dag.Tip)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		root, ok := loaded.(*stagedNode)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("tip %s not found", b.dag.Tip.String())
+		}
+		b.root = root
+	}
+
+	var cur interface{} = b.root.obj
+	replaceCur := func(interface{}) error {
+		return fmt.Errorf("can not replace the root of a dag")
+	}
+	root := b.root
+	touch := func() error {
+		root.dirty = true
+		return nil
+	}
+	for _, key := range path[:len(path)-1] {
+		child, err := getChild(ctx, cur, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		switch staged := child.(type) {
+		case cid.Cid:
+			loaded, err := b.load(ctx, staged)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if loaded != nil {
+				child = loaded
+				if err := stageChild(ctx, cur, key, loaded); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+		case *stagedLink:
+			// a value set with SetAsLink is changed like any loaded node
+			node, err := stagedLinkNode(staged)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if node != nil {
+				child = node
+				if err := setChild(ctx, cur, key, node); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+		}
+
+		var next interface{}
+		switch child := child.(type) {
+		case *stagedNode:
+			next = child.obj
+		case *shard:
+			next = child
+		case map[string]interface{}, []interface{}:
+			// an object or list inside of the same node
+			next = child
+		default:
+			if !create {
+				return nil, nil, nil, nil
+			}
+			created := &stagedNode{obj: make(map[string]interface{})}
+			if err := setChild(ctx, cur, key, created); err != nil {
+				return nil, nil, nil, err
+			}
+			child = created
+			next = created.obj
+		}
+
+		parent, parentKey, touchParent := cur, key, touch
+		replaceCur = func(val interface{}) error {
+			return setChild(ctx, parent, parentKey, val)
+		}
+		staged := child
+		touch = func() error {
+			if err := touchParent(); err != nil {
+				return err
+			}
+			switch staged := staged.(type) {
+			case *stagedNode:
+				staged.dirty = true
+			default:
+				if s, ok := parent.(*shard); ok {
+					// setting the entry again marks the shard nodes on the way to it
+					entry, err := s.get(ctx, parentKey)
+					if err != nil {
+						return err
+					}
+					return s.set(ctx, parentKey, entry.Value)
+				}
+			}
+			return nil
+		}
+		cur = next
+	}
+	return cur, replaceCur, touch, nil
+}
+
+// stagedLinkNode returns the value of link as a new stagedNode, or nil if it isn't an object
+func stagedLinkNode(link *stagedLink) (*stagedNode, error) {
+	sw := &safewrap.SafeWrap{}
+	n := sw.WrapObject(link.val)
+	if sw.Err != nil {
+		return nil, fmt.Errorf("error wrapping object: %v", sw.Err)
+	}
+	var obj interface{}
+	err := cbornode.DecodeInto(n.RawData(), &obj)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding object: %v", err)
+	}
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	return &stagedNode{obj: m}, nil
+}
+
+// stageChild swaps the link at key for the loaded node it points to, which doesn't change
+// container
+func stageChild(ctx context.Context, container interface{}, key string, loaded interface{}) error {
+	if s, ok := container.(*shard); ok {
+		entry, err := s.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("key %s not found", key)
+		}
+		entry.Value = loaded
+		return nil
+	}
+	return setChild(ctx, container, key, loaded)
+}
+
+func getChild(ctx context.Context, container interface{}, key string) (interface{}, error) {
+	switch container := container.(type) {
+	case *shard:
+		entry, err := container.get(ctx, key)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return entry.Value, nil
+	case map[string]interface{}:
+		return container[key], nil
+	case []interface{}:
+		idx, err := listIndex(key, len(container))
+		if err != nil {
+			return nil, err
+		}
+		return container[idx], nil
+	default:
+		return nil, nil
+	}
+}
+
+func setChild(ctx context.Context, container interface{}, key string, val interface{}) error {
+	switch container := container.(type) {
+	case *shard:
+		return container.set(ctx, key, val)
+	case map[string]interface{}:
+		container[key] = val
+		return nil
+	case []interface{}:
+		idx, err := listIndex(key, len(container))
+		if err != nil {
+			return err
+		}
+		container[idx] = val
+		return nil
+	default:
+		return fmt.Errorf("can not set %s in %v", key, container)
+	}
+}
+
+// load decodes a fresh copy of the node (as a *stagedNode or a *shard) so changes never
+// leak into cached nodes, nodes which are missing or aren't objects return nil
+func (b *Builder) load(ctx context.Context, id cid.Cid) (interface{}, error) {
+	n, err := b.dag.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+	}
+	if n == nil {
+		return nil, nil
+	}
+	if isShardNode(n) {
+		return b.dag.loadShard(n)
+	}
+	var obj interface{}
+	err = cbornode.DecodeInto(n.RawData(), &obj)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding node (%s): %v", id.String(), err)
+	}
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	return &stagedNode{obj: m, id: id}, nil
+}
+
+// write replaces staged nodes and links inside val with the CIDs of newly created nodes
+// and reports whether val changed, nodes which didn't change keep their CIDs
+func (b *Builder) write(ctx context.Context, batch *format.Batch, val interface{}) (interface{}, bool, error) {
+	switch val := val.(type) {
+	case *stagedNode:
+		obj, changed, err := b.write(ctx, batch, val.obj)
+		if err != nil {
+			return nil, false, err
+		}
+		if !changed && !val.dirty && val.id.Defined() {
+			return val.id, false, nil
+		}
+		n, err := b.dag.createNode(ctx, batch, obj)
+		if err != nil {
+			return nil, false, fmt.Errorf("error creating node: %v", err)
+		}
+		return n.Cid(), true, nil
+	case *shard:
+		return val.write(ctx, batch, func(v interface{}) (interface{}, bool, error) {
+			return b.write(ctx, batch, v)
+		})
+	case *stagedLink:
+		n, err := b.dag.createNode(ctx, batch, val.val)
+		if err != nil {
+			return nil, false, fmt.Errorf("error creating node: %v", err)
+		}
+		return n.Cid(), true, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		var changed bool
+		for k, v := range val {
+			written, childChanged, err := b.write(ctx, batch, v)
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || childChanged
+			out[k] = written
+		}
+		return out, changed, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		var changed bool
+		for i, v := range val {
+			written, childChanged, err := b.write(ctx, batch, v)
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || childChanged
+			out[i] = written
+		}
+		return out, changed, nil
+	default:
+		return val, false, nil
+	}
+}
@@ -0,0 +1,150 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	original := newDeepAndWideDag(t, ctx)
+	store := &countingStore{DagStore: original.Store}
+	base := original.WithNewTip(original.Tip)
+	base.Store = store
+
+	// the same changes applied one by one
+	expected := base
+	var err error
+	for i := 0; i < 10; i++ {
+		expected, err = expected.Set(ctx, []string{"child1", "deepChild1", fmt.Sprintf("key%d", i)}, i)
+		require.Nil(t, err)
+	}
+	expected, err = expected.Set(ctx, []string{"a", "new", "path"}, "value")
+	require.Nil(t, err)
+	expected, err = expected.SetAsLink(ctx, []string{"child2", "linked"}, map[string]interface{}{"hi": "there"})
+	require.Nil(t, err)
+	expected, err = expected.Delete(ctx, []string{"root"})
+	require.Nil(t, err)
+
+	store.addManys = 0
+	builder := base.NewBuilder()
+	for i := 0; i < 10; i++ {
+		err := builder.Set(ctx, []string{"child1", "deepChild1", fmt.Sprintf("key%d", i)}, i)
+		require.Nil(t, err)
+	}
+	require.Nil(t, builder.Set(ctx, []string{"a", "new", "path"}, "value"))
+	require.Nil(t, builder.SetAsLink(ctx, []string{"child2", "linked"}, map[string]interface{}{"hi": "there"}))
+	require.Nil(t, builder.Delete(ctx, []string{"root"}))
+
+	// nothing is written until the commit
+	assert.Equal(t, 0, store.addManys)
+	assert.Equal(t, 0, store.adds)
+
+	committed, err := builder.Commit(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 1, store.addManys)
+	assert.True(t, expected.Tip.Equals(committed.Tip))
+
+	// the original tip is untouched
+	val, _, err := base.Resolve(ctx, []string{"child1", "deepChild1", "key0"})
+	require.Nil(t, err)
+	assert.Nil(t, val)
+
+	t.Run("builders carry on from the commit", func(t *testing.T) {
+		require.Nil(t, builder.Set(ctx, []string{"another"}, true))
+		next, err := builder.Commit(ctx)
+		require.Nil(t, err)
+		val, _, err := next.Resolve(ctx, []string{"a", "new", "path"})
+		require.Nil(t, err)
+		assert.Equal(t, "value", val)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		builder := base.NewBuilder()
+		assert.NotNil(t, builder.Delete(ctx, []string{"nope", "nope"}))
+		assert.NotNil(t, builder.Delete(ctx, []string{"child1", "nope"}))
+		assert.NotNil(t, builder.Set(ctx, []string{"obj"}, map[string]string{}))
+		assert.NotNil(t, builder.Set(ctx, []string{}, 1))
+	})
+}
+
+func TestBuilderSetsInsideStagedLinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := newDeepAndWideDag(t, ctx)
+
+	expected, err := base.SetAsLink(ctx, []string{"a"}, map[string]interface{}{"keep": "me"})
+	require.Nil(t, err)
+	expected, err = expected.Set(ctx, []string{"a", "y"}, 2)
+	require.Nil(t, err)
+
+	builder := base.NewBuilder()
+	require.Nil(t, builder.SetAsLink(ctx, []string{"a"}, map[string]interface{}{"keep": "me"}))
+	require.Nil(t, builder.Set(ctx, []string{"a", "y"}, 2))
+	committed, err := builder.Commit(ctx)
+	require.Nil(t, err)
+	assert.True(t, expected.Tip.Equals(committed.Tip))
+
+	val, _, err := committed.Resolve(ctx, []string{"a", "keep"})
+	require.Nil(t, err)
+	assert.Equal(t, "me", val)
+}
+
+func TestBuilderOnlyWritesChangedNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	original := newDeepAndWideDag(t, ctx)
+	store := &countingStore{DagStore: original.Store}
+	base := original.WithNewTip(original.Tip)
+	base.Store = store
+
+	builder := base.NewBuilder()
+	assert.NotNil(t, builder.Delete(ctx, []string{"child1", "deepChild1", "nope"}))
+	assert.NotNil(t, builder.Delete(ctx, []string{"child2", "deepChild2", "nope"}))
+	committed, err := builder.Commit(ctx)
+	require.Nil(t, err)
+	assert.True(t, committed.Tip.Equals(base.Tip))
+	assert.Equal(t, 0, store.nodes)
+
+	// only the changed node and its ancestors are written, not its loaded siblings
+	require.Nil(t, builder.Set(ctx, []string{"child2", "deepChild2", "x"}, 1))
+	assert.NotNil(t, builder.Delete(ctx, []string{"child1", "deepChild1", "nope"}))
+	committed, err = builder.Commit(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 3, store.nodes)
+
+	expected, err := base.Set(ctx, []string{"child2", "deepChild2", "x"}, 1)
+	require.Nil(t, err)
+	assert.True(t, expected.Tip.Equals(committed.Tip))
+
+	t.Run("sharded maps", func(t *testing.T) {
+		sharded, err := original.ShardMap(ctx, []string{"sharded"})
+		require.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			sharded, err = sharded.Set(ctx, []string{"sharded", fmt.Sprintf("key%d", i)}, i)
+			require.Nil(t, err)
+		}
+		store := &countingStore{DagStore: sharded.Store}
+		sharded = sharded.WithNewTip(sharded.Tip)
+		sharded.Store = store
+
+		builder := sharded.NewBuilder()
+		assert.NotNil(t, builder.Delete(ctx, []string{"sharded", "nope"}))
+		require.Nil(t, builder.Set(ctx, []string{"sharded", "key1"}, "changed"))
+		committed, err := builder.Commit(ctx)
+		require.Nil(t, err)
+
+		expected, err := sharded.Set(ctx, []string{"sharded", "key1"}, "changed")
+		require.Nil(t, err)
+		assert.True(t, expected.Tip.Equals(committed.Tip))
+		assert.Less(t, store.nodes, 5)
+	})
+}
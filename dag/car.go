@@ -0,0 +1,229 @@
+package dag
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/nodestore"
+)
+
+func init() {
+	cbornode.RegisterCborType(carHeader{})
+}
+
+// carHeader is the header of a CARv1 file, see https://ipld.io/specs/transport/car/carv1/
+type carHeader struct {
+	Roots   []cid.Cid `refmt:"roots" json:"roots" cbor:"roots"`
+	Version uint64    `refmt:"version" json:"version" cbor:"version"`
+}
+
+// maxCarSectionSize protects ImportCAR from allocating huge buffers for corrupt input
+const maxCarSectionSize = 32 << 20
+
+// ExportCAR writes the dag as a CARv1 file with the Tip as its only root. With a non-empty
+// path only the nodes along the path and everything below it are written (see
+// NodesForPathWithDecendants), which is enough to resolve that path from the Tip.
+// Nodes missing from the store are left out.
+func (d *Dag) ExportCAR(ctx context.Context, w io.Writer, path []string) error {
+	bw := bufio.NewWriter(w)
+
+	header, err := cbornode.DumpObject(&carHeader{Roots: []cid.Cid{d.Tip}, Version: 1})
+	if err != nil {
+		return fmt.Errorf("error encoding header: %v", err)
+	}
+	err = writeCarSection(bw, header)
+	if err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		seen := make(map[cid.Cid]struct{})
+		err = d.Walk(ctx, func(_ []string, n format.Node) error {
+			if _, ok := seen[n.Cid()]; ok {
+				return SkipNode
+			}
+			seen[n.Cid()] = struct{}{}
+			return writeCarBlock(bw, n)
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+
+	nodes, err := d.NodesForPathWithDecendants(ctx, path)
+	if err != nil {
+		return fmt.Errorf("error getting nodes for path %v: %v", path, err)
+	}
+	// the root goes first so readers can start resolving straight away
+	for _, n := range nodes {
+		if n.Cid().Equals(d.Tip) {
+			if err := writeCarBlock(bw, n); err != nil {
+				return err
+			}
+		}
+	}
+	for _, n := range nodes {
+		if !n.Cid().Equals(d.Tip) {
+			if err := writeCarBlock(bw, n); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ImportCAR reads a CARv1 file into store and returns its root. The hash of every block
+// is checked against its CID before anything is stored. Files with more than one root are
+// rejected since a Dag only has a single tip, and so are files which don't contain the
+// block of their root.
+func ImportCAR(ctx context.Context, store nodestore.DagStore, r io.Reader) (cid.Cid, error) {
+	br := bufio.NewReader(r)
+
+	headerBytes, err := readCarSection(br)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error reading header: %v", err)
+	}
+	header := &carHeader{}
+	err = cbornode.DecodeInto(headerBytes, header)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error decoding header: %v", err)
+	}
+	if header.Version != 1 {
+		return cid.Undef, fmt.Errorf("unsupported CAR version: %d", header.Version)
+	}
+	if len(header.Roots) != 1 {
+		return cid.Undef, fmt.Errorf("expected exactly one root, got %d", len(header.Roots))
+	}
+
+	root := header.Roots[0]
+	hasRoot := false
+	var nodes []format.Node
+	for {
+		section, err := readCarSection(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, fmt.Errorf("error reading block: %v", err)
+		}
+
+		id, data, err := splitCarBlock(section)
+		if err != nil {
+			return cid.Undef, err
+		}
+		sum, err := id.Prefix().Sum(data)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("error hashing block (%s): %v", id.String(), err)
+		}
+		if !sum.Equals(id) {
+			return cid.Undef, fmt.Errorf("block does not match its CID (%s)", id.String())
+		}
+
+		blk, err := blocks.NewBlockWithCid(data, id)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("error creating block (%s): %v", id.String(), err)
+		}
+		n, err := format.Decode(blk)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("error decoding block (%s): %v", id.String(), err)
+		}
+		if err := checkNode(n); err != nil {
+			return cid.Undef, err
+		}
+		nodes = append(nodes, n)
+		hasRoot = hasRoot || id.Equals(root)
+	}
+	if !hasRoot {
+		return cid.Undef, fmt.Errorf("root block (%s) is missing", root.String())
+	}
+
+	err = store.AddMany(ctx, nodes)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error adding nodes: %v", err)
+	}
+	return root, nil
+}
+
+func writeCarBlock(w io.Writer, n format.Node) error {
+	return writeCarSection(w, n.Cid().Bytes(), n.RawData())
+}
+
+func writeCarSection(w io.Writer, data ...[]byte) error {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(buf[:binary.PutUvarint(buf, uint64(length))])
+	if err != nil {
+		return fmt.Errorf("error writing section: %v", err)
+	}
+	for _, d := range data {
+		if _, err := w.Write(d); err != nil {
+			return fmt.Errorf("error writing section: %v", err)
+		}
+	}
+	return nil
+}
+
+// readCarSection returns io.EOF only when the reader ends cleanly between sections
+func readCarSection(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxCarSectionSize {
+		return nil, fmt.Errorf("section too large: %d", length)
+	}
+	section := make([]byte, length)
+	_, err = io.ReadFull(r, section)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return section, err
+}
+
+// splitCarBlock separates the CID at the start of a block section from the block data
+func splitCarBlock(section []byte) (cid.Cid, []byte, error) {
+	length, err := cidLength(section)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	id, err := cid.Cast(section[:length])
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("error decoding CID: %v", err)
+	}
+	return id, section[length:], nil
+}
+
+// cidLength returns the length of the binary CID at the start of data
+func cidLength(data []byte) (int, error) {
+	// CIDv0 is a bare sha2-256 multihash
+	if len(data) >= 34 && data[0] == 0x12 && data[1] == 0x20 {
+		return 34, nil
+	}
+
+	offset := 0
+	// version, codec, multihash code and multihash length
+	var vals [4]uint64
+	for i := range vals {
+		val, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return 0, fmt.Errorf("error decoding CID: bad varint")
+		}
+		vals[i] = val
+		offset += n
+	}
+	if vals[3] > uint64(len(data)-offset) {
+		return 0, fmt.Errorf("error decoding CID: multihash too short")
+	}
+	return offset + int(vals[3]), nil
+}
@@ -0,0 +1,102 @@
+package dag
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+
+	buf := &bytes.Buffer{}
+	err := dag.ExportCAR(ctx, buf, nil)
+	require.Nil(t, err)
+	exported := buf.Bytes()
+
+	store := nodestore.MustMemoryStore(ctx)
+	root, err := ImportCAR(ctx, store, bytes.NewReader(exported))
+	require.Nil(t, err)
+	assert.True(t, root.Equals(dag.Tip))
+
+	imported := NewDag(ctx, root, store)
+	nodes, err := imported.Nodes(ctx)
+	require.Nil(t, err)
+	original, err := dag.Nodes(ctx)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, cidsOf(original), cidsOf(nodes))
+
+	t.Run("limited to a path", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err := dag.ExportCAR(ctx, buf, []string{"child1"})
+		require.Nil(t, err)
+
+		store := nodestore.MustMemoryStore(ctx)
+		root, err := ImportCAR(ctx, store, buf)
+		require.Nil(t, err)
+
+		imported := NewDag(ctx, root, store)
+		nodes, err := imported.Nodes(ctx)
+		require.Nil(t, err)
+		// root, child1 and deepChild but not child2
+		assert.Len(t, nodes, 3)
+
+		val, _, err := imported.Resolve(ctx, []string{"child1", "deepChild1", "deepChild"})
+		require.Nil(t, err)
+		assert.Equal(t, true, val)
+	})
+
+	t.Run("corrupt blocks are rejected", func(t *testing.T) {
+		corrupt := append([]byte{}, exported...)
+		// flip the last byte of the last block
+		corrupt[len(corrupt)-1] ^= 0xff
+
+		store := nodestore.MustMemoryStore(ctx)
+		_, err := ImportCAR(ctx, store, bytes.NewReader(corrupt))
+		require.NotNil(t, err)
+
+		_, err = ImportCAR(ctx, store, bytes.NewReader(exported[:len(exported)-1]))
+		require.NotNil(t, err)
+	})
+
+	t.Run("the root block must be included", func(t *testing.T) {
+		sw := &safewrap.SafeWrap{}
+		missing := sw.WrapObject(map[string]string{"not": "exported"})
+		require.Nil(t, sw.Err)
+
+		buf := &bytes.Buffer{}
+		header, err := cbornode.DumpObject(&carHeader{Roots: []cid.Cid{missing.Cid()}, Version: 1})
+		require.Nil(t, err)
+		require.Nil(t, writeCarSection(buf, header))
+		for _, n := range original {
+			require.Nil(t, writeCarBlock(buf, n))
+		}
+
+		store := nodestore.MustMemoryStore(ctx)
+		_, err = ImportCAR(ctx, store, buf)
+		require.NotNil(t, err)
+
+		// nothing is stored
+		_, err = store.Get(ctx, dag.Tip)
+		assert.Equal(t, format.ErrNotFound, err)
+	})
+}
+
+func cidsOf(nodes []format.Node) []cid.Cid {
+	ids := make([]cid.Cid, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.Cid()
+	}
+	return ids
+}
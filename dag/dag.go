@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"strconv"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
@@ -44,14 +45,19 @@ func NewDagWithNodes(ctx context.Context, store nodestore.DagStore, nodes ...for
 	return dag, nil
 }
 
-// AddNodes takes cbornodes and adds them to the underlying storage
+// AddNodes takes cbornodes and adds them to the underlying storage in a single AddMany.
+// Nodes which use the key reserved for sharded maps without being valid nodes of one
+// are rejected.
 func (d *Dag) AddNodes(ctx context.Context, nodes ...format.Node) error {
-	for _, node := range nodes {
-		err := d.Store.Add(ctx, node)
-		if err != nil {
-			return fmt.Errorf("error storing node (%s): %v", node.Cid().String(), err)
+	for _, n := range nodes {
+		if err := checkNode(n); err != nil {
+			return err
 		}
 	}
+	err := d.Store.AddMany(ctx, nodes)
+	if err != nil {
+		return fmt.Errorf("error storing nodes: %v", err)
+	}
 	return nil
 }
 
@@ -75,6 +81,9 @@ func (d *Dag) Get(ctx context.Context, id cid.Cid) (format.Node, error) {
 // CreateNode adds an object to the Dags underlying storage (doesn't change the tip)
 // and returns the cbornode
 func (d *Dag) CreateNode(ctx context.Context, obj interface{}) (format.Node, error) {
+	if err := checkReserved(nil, obj); err != nil {
+		return nil, err
+	}
 	sw := &safewrap.SafeWrap{}
 	n := sw.WrapObject(obj)
 	if sw.Err != nil {
@@ -83,6 +92,16 @@ func (d *Dag) CreateNode(ctx context.Context, obj interface{}) (format.Node, err
 	return n, d.Store.Add(ctx, n)
 }
 
+// createNode is CreateNode but adds the node to batch instead of the store
+func (d *Dag) createNode(ctx context.Context, batch *format.Batch, obj interface{}) (format.Node, error) {
+	sw := &safewrap.SafeWrap{}
+	n := sw.WrapObject(obj)
+	if sw.Err != nil {
+		return nil, fmt.Errorf("error wrapping object: %v", sw.Err)
+	}
+	return n, batch.Add(ctx, n)
+}
+
 func (d *Dag) ResolveInto(ctx context.Context, path []string, obj interface{}) error {
 	var initialPath []string
 	var lastKey string
@@ -100,24 +119,36 @@ func (d *Dag) ResolveInto(ctx context.Context, path []string, obj interface{}) e
 		if err != nil {
 			return fmt.Errorf("error getting tip: %v", err)
 		}
-		return cbornode.DecodeInto(n.RawData(), obj)
+		return d.decodeInto(ctx, n, obj)
 	}
-	// otherwise we get a map and use the last key
-	val, remain, err := d.Resolve(ctx, initialPath)
+	// otherwise we get a map (or sharded map) and use the last key
+	val, remain, err := d.resolve(ctx, initialPath)
 	if err != nil {
 		return fmt.Errorf("error getting initialPath: %v", err)
 	}
 	if len(remain) > 0 {
 		return format.ErrNotFound
 	}
-	mapped, ok := val.(map[string]interface{})
-	if !ok {
+	var cidInter interface{}
+	switch container := val.(type) {
+	case *shard:
+		entry, err := container.get(ctx, lastKey)
+		if err != nil {
+			return fmt.Errorf("error getting %s from sharded map: %v", lastKey, err)
+		}
+		if entry == nil {
+			return format.ErrNotFound
+		}
+		cidInter = entry.Value
+	case map[string]interface{}:
+		var ok bool
+		cidInter, ok = container[lastKey]
+		if !ok {
+			return format.ErrNotFound
+		}
+	default:
 		return fmt.Errorf("error the path you specify must resolve to an object with links")
 	}
-	cidInter, ok := mapped[lastKey]
-	if !ok {
-		return format.ErrNotFound
-	}
 	id, ok := cidInter.(cid.Cid)
 	if !ok {
 		return fmt.Errorf("error the path did not resolve to a link")
@@ -126,7 +157,24 @@ func (d *Dag) ResolveInto(ctx context.Context, path []string, obj interface{}) e
 	if err != nil {
 		return fmt.Errorf("error getting cid: %v", err)
 	}
-	return cbornode.DecodeInto(n.RawData(), obj)
+	return d.decodeInto(ctx, n, obj)
+}
+
+// decodeInto decodes n into obj, a sharded map is decoded like a map with all of its entries
+func (d *Dag) decodeInto(ctx context.Context, n format.Node, obj interface{}) error {
+	if !isShardNode(n) {
+		return cbornode.DecodeInto(n.RawData(), obj)
+	}
+	entries, err := d.nodeValue(ctx, n)
+	if err != nil {
+		return err
+	}
+	sw := &safewrap.SafeWrap{}
+	wrapped := sw.WrapObject(entries)
+	if sw.Err != nil {
+		return fmt.Errorf("error wrapping sharded map: %v", sw.Err)
+	}
+	return cbornode.DecodeInto(wrapped.RawData(), obj)
 }
 
 // Resolve takes a path (as a string slice) and returns the value, remaining path and any error.
@@ -137,16 +185,29 @@ func (d *Dag) Resolve(ctx context.Context, path []string) (interface{}, []string
 // ResolveAt takes a tip and a path (as a string slice) and returns the value, remaining path
 // and any error.
 func (d *Dag) ResolveAt(ctx context.Context, tip cid.Cid, path []string) (val interface{}, remaining []string, err error) {
+	return d.resolveAt(ctx, tip, path, false)
+}
+
+// resolve is Resolve, except that a sharded map at the end of path is returned as a *shard
+// so that it can be changed
+func (d *Dag) resolve(ctx context.Context, path []string) (interface{}, []string, error) {
+	return d.resolveAt(ctx, d.Tip, path, true)
+}
+
+func (d *Dag) resolveAt(ctx context.Context, tip cid.Cid, path []string, raw bool) (val interface{}, remaining []string, err error) {
 	node, err := d.Store.Get(ctx, tip)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error getting node (%s): %v", tip.String(), err)
 	}
+	if isShardNode(node) {
+		return d.resolveShard(ctx, node, path, raw)
+	}
 	val, remaining, err = node.Resolve(path)
 	if err != nil {
 		switch err {
-		case cbornode.ErrNoSuchLink:
-			// If the link is just missing, then just return the whole path as remaining, with a nil value
-			// instead of an error
+		case cbornode.ErrNoSuchLink, cbornode.ErrArrayOutOfRange:
+			// If the link (or list element) is just missing, then just return the whole path as remaining,
+			// with a nil value instead of an error
 			return nil, path, nil
 		case cbornode.ErrNoLinks:
 			// this means there was a simple value somewhere along the path
@@ -175,7 +236,7 @@ func (d *Dag) ResolveAt(ctx context.Context, tip cid.Cid, path []string) (val in
 			return nil, nil, fmt.Errorf("error getting linked node (%s) at path %v: %v", val.Cid, path, err)
 		}
 		if linkNode != nil {
-			return d.ResolveAt(ctx, linkNode.Cid(), remaining)
+			return d.resolveAt(ctx, linkNode.Cid(), remaining, raw)
 		}
 		return nil, remaining, nil
 	default:
@@ -183,6 +244,114 @@ func (d *Dag) ResolveAt(ctx context.Context, tip cid.Cid, path []string) (val in
 	}
 }
 
+// resolveShard resolves path in the sharded map with its root at node
+func (d *Dag) resolveShard(ctx context.Context, node format.Node, path []string, raw bool) (interface{}, []string, error) {
+	s, err := d.loadShard(node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(path) == 0 {
+		if raw {
+			return s, nil, nil
+		}
+		obj, err := s.toMap(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return obj, nil, nil
+	}
+
+	entry, err := s.get(ctx, path[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry == nil {
+		return nil, path, nil
+	}
+
+	val, remaining := resolveValue(entry.Value, path[1:])
+	if id, ok := val.(cid.Cid); ok {
+		linkNode, err := d.Store.Get(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting linked node (%s) at path %v: %v", id, path, err)
+		}
+		if linkNode != nil {
+			return d.resolveAt(ctx, linkNode.Cid(), remaining, raw)
+		}
+		return nil, remaining, nil
+	}
+	return val, remaining, nil
+}
+
+// resolveValue carries on through whatever is inside of val (a value inside of a node)
+// like node.Resolve would, stopping at the first link. When something along path is
+// missing nil is returned along with the path from there.
+func resolveValue(val interface{}, path []string) (interface{}, []string) {
+	for len(path) > 0 {
+		switch v := val.(type) {
+		case cid.Cid:
+			return v, path
+		case map[string]interface{}:
+			next, ok := v[path[0]]
+			if !ok {
+				return nil, path
+			}
+			val, path = next, path[1:]
+		case []interface{}:
+			idx, err := listIndex(path[0], len(v))
+			if err != nil {
+				return nil, path
+			}
+			val, path = v[idx], path[1:]
+		default:
+			return val, path
+		}
+	}
+	return val, nil
+}
+
+// ResolveNode resolves path inside of n alone, without loading any other node (which is
+// what proofs are checked with). It works like n.Resolve, returning a *format.Link along
+// with the path below it for a link along path, except that the nodes of sharded maps are
+// searched for the key instead of being resolved as they are encoded. shardDepth is the
+// depth of n in its sharded map (0 for the root of a map and for any other node). When the
+// returned link points to the next node of the same sharded map the remaining path still
+// starts with the key and nextShardDepth is the depth of that node, otherwise it is 0. A
+// sharded map is spread over many nodes so resolving the empty path in one is an error.
+func ResolveNode(n format.Node, path []string, shardDepth int) (val interface{}, remaining []string, nextShardDepth int, err error) {
+	if !isShardNode(n) {
+		val, remaining, err = n.Resolve(path)
+		return val, remaining, 0, err
+	}
+	if len(path) == 0 {
+		return nil, nil, 0, fmt.Errorf("node (%s) is part of a sharded map", n.Cid().String())
+	}
+
+	node, err := decodeShardNode(n)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	entry, next, err := node.findEntry(path[0], shardDepth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if next != nil {
+		return &format.Link{Cid: *next}, path, shardDepth + 1, nil
+	}
+	if entry == nil {
+		return nil, nil, 0, cbornode.ErrNoSuchLink
+	}
+
+	val, remaining = resolveValue(entry.Value, path[1:])
+	if id, ok := val.(cid.Cid); ok {
+		return &format.Link{Cid: id}, remaining, 0, nil
+	}
+	if val == nil || len(remaining) > 0 {
+		return nil, nil, 0, cbornode.ErrNoSuchLink
+	}
+	return val, nil, 0, nil
+}
+
 func (d *Dag) NodesForPathWithDecendants(ctx context.Context, path []string) ([]format.Node, error) {
 	nodes, err := d.orderedNodesForPath(ctx, path)
 	if err != nil {
@@ -214,32 +383,41 @@ func (d *Dag) NodesForPath(ctx context.Context, path []string) ([]format.Node, e
 }
 
 func (d *Dag) orderedNodesForPath(ctx context.Context, path []string) ([]format.Node, error) {
-	nodes := make([]format.Node, len(path)+1) // + 1 for tip node
-
 	tipNode, err := d.Get(ctx, d.Tip)
 	if err != nil {
 		return nil, err
 	}
 
-	nodes[0] = tipNode
+	nodes := []format.Node{tipNode}
 	cur := tipNode
+	shardDepth := 0
 
-	for i, val := range path {
-		nextNode, remaining, err := cur.ResolveLink([]string{val})
+	// sharded maps take a node for every level of the map they go through
+	for len(path) > 0 {
+		val, remaining, nextShardDepth, err := ResolveNode(cur, path[:1], shardDepth)
 		if err != nil {
 			return nil, err
 		}
-
-		if len(remaining) > 0 {
-			return nil, fmt.Errorf("error: unexpected remaining path elements: %v", remaining)
+		nextNode, ok := val.(*format.Link)
+		if !ok {
+			return nil, fmt.Errorf("error: %s is not a link", path[0])
+		}
+		if nextShardDepth == 0 {
+			if len(remaining) > 0 {
+				return nil, fmt.Errorf("error: unexpected remaining path elements: %v", remaining)
+			}
+			path = path[1:]
 		}
+		shardDepth = nextShardDepth
 
 		cur, err = d.Get(ctx, nextNode.Cid)
 		if err != nil {
 			return nil, err
 		}
-
-		nodes[i+1] = cur
+		if cur == nil && len(path) > 0 {
+			return nil, fmt.Errorf("error: missing node (%s)", nextNode.Cid.String())
+		}
+		nodes = append(nodes, cur)
 	}
 
 	return nodes, nil
@@ -300,7 +478,7 @@ func (d *Dag) Delete(ctx context.Context, path []string) (*Dag, error) {
 	}
 
 	parentPath := path[:len(path)-1]
-	parentObj, remaining, err := d.Resolve(ctx, parentPath)
+	parentObj, remaining, err := d.resolve(ctx, parentPath)
 
 	if err != nil {
 		return nil, fmt.Errorf("error resolving parent node: %v", err)
@@ -308,13 +486,41 @@ func (d *Dag) Delete(ctx context.Context, path []string) (*Dag, error) {
 	if len(remaining) > 0 {
 		return nil, fmt.Errorf("path elements remaining after resolving parent node: %v", remaining)
 	}
+	keyToDelete := path[len(path)-1]
+
+	if list, ok := parentObj.([]interface{}); ok {
+		idx, err := listIndex(keyToDelete, len(list))
+		if err != nil {
+			return nil, err
+		}
+		newList := append(append([]interface{}{}, list[:idx]...), list[idx+1:]...)
+		return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+			return d.replace(ctx, batch, parentPath, newList)
+		})
+	}
+
+	if s, ok := parentObj.(*shard); ok {
+		found, err := s.delete(ctx, keyToDelete)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting from sharded map: %v", err)
+		}
+		if !found {
+			return nil, fmt.Errorf("key %v does not exist at path %v", keyToDelete, parentPath)
+		}
+		return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+			id, _, err := s.write(ctx, batch, nil)
+			if err != nil {
+				return nil, err
+			}
+			return d.replace(ctx, batch, parentPath, id)
+		})
+	}
+
 	parentMap, ok := parentObj.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("error asserting type map[string]interface{} of parent node: %v", parentObj)
 	}
 
-	keyToDelete := path[len(path)-1]
-
 	if _, ok := parentMap[keyToDelete]; !ok {
 		return nil, fmt.Errorf("key %v does not exist at path %v", keyToDelete, parentPath)
 	}
@@ -324,36 +530,110 @@ func (d *Dag) Delete(ctx context.Context, path []string) (*Dag, error) {
 	return d.Update(ctx, parentPath, parentObj)
 }
 
-// Update returns a new Dag with the old node at path swapped out for the new object
+// Update returns a new Dag with the old node at path swapped out for the new object.
+// All of the new nodes are written in one batch.
 func (d *Dag) Update(ctx context.Context, path []string, newObj interface{}) (*Dag, error) {
-	updatedNode, err := d.CreateNode(ctx, newObj)
+	if err := checkReserved(path, newObj); err != nil {
+		return nil, err
+	}
+	return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+		return d.update(ctx, batch, path, newObj)
+	})
+}
+
+// withBatch runs fn with a new batch which is committed when fn succeeds
+func (d *Dag) withBatch(ctx context.Context, fn func(batch *format.Batch) (*Dag, error)) (*Dag, error) {
+	batch := format.NewBatch(ctx, d.Store)
+	newDag, err := fn(batch)
+	if err != nil {
+		return nil, err
+	}
+	err = batch.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error committing nodes: %v", err)
+	}
+	return newDag, nil
+}
+
+func (d *Dag) update(ctx context.Context, batch *format.Batch, path []string, newObj interface{}) (*Dag, error) {
+	updatedNode, err := d.createNode(ctx, batch, newObj)
 	if err != nil {
 		return nil, fmt.Errorf("error creating node: %v", err)
 	}
+	return d.replace(ctx, batch, path, updatedNode.Cid())
+}
+
+// replace puts val (a link or a plain value) at path and rewrites every ancestor up to a
+// new tip. Objects along the way become new nodes while lists stay inline in their parent.
+func (d *Dag) replace(ctx context.Context, batch *format.Batch, path []string, val interface{}) (*Dag, error) {
 	if len(path) == 0 {
 		// We've updated all ancestors and have a new tip to set
-		return d.WithNewTip(updatedNode.Cid()), nil
-	} else {
-		// We've got more path to recursively update; store this node & update its ref in its parent
-		parentPath := path[:len(path)-1]
-		parentObj, remaining, err := d.Resolve(ctx, parentPath)
+		tip, ok := val.(cid.Cid)
+		if !ok {
+			return nil, fmt.Errorf("the root of a dag must be a node, got: %v", val)
+		}
+		return d.WithNewTip(tip), nil
+	}
+
+	// We've got more path to recursively update; update the value in its parent
+	parentPath := path[:len(path)-1]
+	key := path[len(path)-1]
+	parentObj, remaining, err := d.resolve(ctx, parentPath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving parent node: %v", err)
+	}
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("path elements remaining after resolving parent node: %v", remaining)
+	}
+
+	switch parent := parentObj.(type) {
+	case map[string]interface{}:
+		parent[key] = val
+		return d.update(ctx, batch, parentPath, parent)
+	case *shard:
+		err := parent.set(ctx, key, val)
 		if err != nil {
-			return nil, fmt.Errorf("error resolving parent node: %v", err)
+			return nil, fmt.Errorf("error setting %s in sharded map: %v", key, err)
 		}
-		if len(remaining) > 0 {
-			return nil, fmt.Errorf("path elements remaining after resolving parent node: %v", remaining)
+		id, _, err := parent.write(ctx, batch, nil)
+		if err != nil {
+			return nil, err
 		}
-		parentMap, ok := parentObj.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("error asserting type map[string]interface{} of parent node: %v", parentObj)
+		return d.replace(ctx, batch, parentPath, id)
+	case []interface{}:
+		idx, err := listIndex(key, len(parent))
+		if err != nil {
+			return nil, err
 		}
-		parentMap[path[len(path)-1]] = updatedNode.Cid()
-		return d.Update(ctx, parentPath, parentMap)
+		parent[idx] = val
+		return d.replace(ctx, batch, parentPath, parent)
+	default:
+		return nil, fmt.Errorf("error asserting type map[string]interface{} of parent node: %v", parentObj)
+	}
+}
+
+// listIndex parses a path element used as an index into a list of length
+func listIndex(key string, length int) (int, error) {
+	idx, err := strconv.Atoi(key)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing list index %q: %v", key, err)
+	}
+	if idx < 0 || idx >= length {
+		return 0, fmt.Errorf("list index %d out of range (length %d)", idx, length)
 	}
+	return idx, nil
 }
 
 func isComplexObj(val interface{}) bool {
-	switch val.(type) {
+	switch val := val.(type) {
+	case []interface{}:
+		// lists are fine as long as everything in them is
+		for _, v := range val {
+			if isComplexObj(v) {
+				return true
+			}
+		}
+		return false
 	// These are the built in type of go (excluding map) plus cid.Cid
 	// Use SetAsLink if attempting to set map
 	case bool, byte, complex64, complex128, error, float32, float64, int, int8, int16, int32, int64, string, uint, uint16, uint32, uint64, uintptr, *cid.Cid, *bool, *byte, *complex64, *complex128, *error, *float32, *float64, *int, *int8, *int16, *int32, *int64, *string, *uint, *uint16, *uint32, *uint64, *uintptr, cid.Cid, []bool, []byte, []complex64, []complex128, []error, []float32, []float64, []int, []int8, []int16, []int32, []int64, []string, []uint, []uint16, []uint32, []uint64, []uintptr, []*cid.Cid, []*bool, []*byte, []*complex64, []*complex128, []*error, []*float32, []*float64, []*int, []*int8, []*int16, []*int32, []*int64, []*string, []*uint, []*uint16, []*uint32, []*uint64, []*uintptr, []cid.Cid:
@@ -378,19 +658,98 @@ func (d *Dag) SetAsLink(ctx context.Context, pathAndKey []string, val interface{
 	return d.set(ctx, pathAndKey, val, true)
 }
 
-func (d *Dag) getExisting(ctx context.Context, path []string) (val map[string]interface{}, remainingPath []string, err error) {
-	existing, remaining, err := d.Resolve(ctx, path)
+// Append adds val to the end of the list at path, creating the list if path doesn't exist yet
+func (d *Dag) Append(ctx context.Context, path []string, val interface{}) (*Dag, error) {
+	return d.Insert(ctx, path, -1, val)
+}
+
+// AppendAsLink adds val as its own node to the end of the list at path, see Append
+func (d *Dag) AppendAsLink(ctx context.Context, path []string, val interface{}) (*Dag, error) {
+	return d.InsertAsLink(ctx, path, -1, val)
+}
+
+// Insert adds val to the list at path so it ends up at index, a negative index appends.
+// The list is created if path doesn't exist yet.
+func (d *Dag) Insert(ctx context.Context, path []string, index int, val interface{}) (*Dag, error) {
+	if isComplexObj(val) {
+		return nil, fmt.Errorf("can not insert complex objects, use InsertAsLink: %v", val)
+	}
+	return d.insert(ctx, path, index, val, false)
+}
+
+// InsertAsLink adds val as its own node to the list at path, see Insert
+func (d *Dag) InsertAsLink(ctx context.Context, path []string, index int, val interface{}) (*Dag, error) {
+	return d.insert(ctx, path, index, val, true)
+}
+
+func (d *Dag) insert(ctx context.Context, path []string, index int, val interface{}, asLink bool) (*Dag, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("must pass in a path")
+	}
+
+	existing, remaining, err := d.resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %s: %v", path, err)
+	}
+	var list []interface{}
+	switch existing := existing.(type) {
+	case []interface{}:
+		if len(remaining) > 0 {
+			return nil, fmt.Errorf("path elements remaining after resolving list: %v", remaining)
+		}
+		list = existing
+	case nil:
+		list = []interface{}{}
+	default:
+		if len(remaining) == 0 {
+			return nil, fmt.Errorf("value at path %v is not a list", path)
+		}
+		list = []interface{}{}
+	}
+
+	if index < 0 {
+		index = len(list)
+	}
+	if index > len(list) {
+		return nil, fmt.Errorf("list index %d out of range (length %d)", index, len(list))
+	}
+
+	return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+		if asLink {
+			n, err := d.createNode(ctx, batch, val)
+			if err != nil {
+				return nil, fmt.Errorf("error creating node: %v", err)
+			}
+			val = n.Cid()
+		}
+
+		newList := make([]interface{}, 0, len(list)+1)
+		newList = append(newList, list[:index]...)
+		newList = append(newList, val)
+		newList = append(newList, list[index:]...)
+
+		if len(remaining) == 0 {
+			return d.replace(ctx, batch, path, newList)
+		}
+		return d.setWithBatch(ctx, batch, path, newList, false)
+	})
+}
+
+// getExisting returns the last map (a map[string]interface{} or a *shard) along path and
+// the path remaining after it
+func (d *Dag) getExisting(ctx context.Context, path []string) (val interface{}, remainingPath []string, err error) {
+	existing, remaining, err := d.resolve(ctx, path)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	if len(remaining) == len(path) {
 		// special case so we don't clobber other keys set at the root level
-		existing, _, _ = d.Resolve(ctx, []string{})
+		existing, _, _ = d.resolve(ctx, []string{})
 	}
 
 	switch existing := existing.(type) {
-	case map[string]interface{}:
+	case map[string]interface{}, *shard:
 		return existing, remaining, nil
 	case nil:
 		// nil can be returned when an object exists at a part of the path, but the next
@@ -406,9 +765,19 @@ func (d *Dag) getExisting(ctx context.Context, path []string) (val map[string]in
 }
 
 func (d *Dag) set(ctx context.Context, pathAndKey []string, val interface{}, asLink bool) (*Dag, error) {
+	return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+		return d.setWithBatch(ctx, batch, pathAndKey, val, asLink)
+	})
+}
+
+func (d *Dag) setWithBatch(ctx context.Context, batch *format.Batch, pathAndKey []string, val interface{}, asLink bool) (*Dag, error) {
 	var path []string
 	var key string
 
+	if err := checkReserved(pathAndKey, val); err != nil {
+		return nil, err
+	}
+
 	switch len(pathAndKey) {
 	case 0:
 		return nil, fmt.Errorf("must pass in a key")
@@ -420,13 +789,51 @@ func (d *Dag) set(ctx context.Context, pathAndKey []string, val interface{}, asL
 		key = pathAndKey[len(pathAndKey)-1]
 	}
 
+	if asLink {
+		// create val as new node, from here on only its CID is needed
+		newLinkNode, err := d.createNode(ctx, batch, val)
+		if err != nil {
+			return nil, fmt.Errorf("error creating node: %v", err)
+		}
+		val = newLinkNode.Cid()
+	}
+
+	// setting an element of an existing list replaces it in place
+	existing, remaining, err := d.resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %s: %v", path, err)
+	}
+	if list, ok := existing.([]interface{}); ok && len(remaining) == 0 {
+		idx, err := listIndex(key, len(list))
+		if err != nil {
+			return nil, err
+		}
+		list[idx] = val
+		return d.replace(ctx, batch, path, list)
+	}
+
 	// lookup existing portion of path & leaf node's value
-	leafNodeObj, remainingPath, err := d.getExisting(ctx, path)
+	existingLeaf, remainingPath, err := d.getExisting(ctx, path)
 	if err != nil {
 		return nil, fmt.Errorf("error resolving path %s: %v", path, err)
 	}
 
 	existingPath := path[:len(path)-len(remainingPath)]
+
+	if _, ok := existingLeaf.(*shard); ok {
+		// a sharded map only gets the one entry changed, so create the missing path
+		// below it and link it in with a single set
+		newPath := append(append([]string{}, remainingPath...), key)
+		for i := len(newPath) - 1; i > 0; i-- {
+			n, err := d.createNode(ctx, batch, map[string]interface{}{newPath[i]: val})
+			if err != nil {
+				return nil, fmt.Errorf("error creating node for path element %s: %v", newPath[i-1], err)
+			}
+			val = n.Cid()
+		}
+		return d.replace(ctx, batch, append(append([]string{}, existingPath...), newPath[0]), val)
+	}
+	leafNodeObj, _ := existingLeaf.(map[string]interface{})
 	/*
 		Alright, there are basically three possible scenarios now:
 		1. The path we're setting doesn't exist at all.
@@ -448,23 +855,13 @@ func (d *Dag) set(ctx context.Context, pathAndKey []string, val interface{}, asL
 	}
 
 	// set key to (link to) val in new leaf node
-	if asLink {
-		// create val as new node and set its CID under key in new leaf node
-		newLinkNode, err := d.CreateNode(ctx, val)
-		if err != nil {
-			return nil, fmt.Errorf("error creating node: %v", err)
-		}
-		newLeafNodeObj[key] = newLinkNode.Cid()
-	} else {
-		// set key to val in new leaf node
-		newLeafNodeObj[key] = val
-	}
+	newLeafNodeObj[key] = val
 
 	// create any missing path segments, starting with the new leaf node
 	// go up (i.e. right to left) the path segments, linking them as we go
 	nextNodeObj := newLeafNodeObj
 	for i := len(remainingPath) - 1; i >= 0; i-- {
-		nextNode, err := d.CreateNode(ctx, nextNodeObj)
+		nextNode, err := d.createNode(ctx, batch, nextNodeObj)
 		if err != nil {
 			return nil, fmt.Errorf("error creating node for path element %s: %v", remainingPath[i], err)
 		}
@@ -479,7 +876,7 @@ func (d *Dag) set(ctx context.Context, pathAndKey []string, val interface{}, asL
 	}
 
 	// update former leaf node to (link to) new val
-	newDag, err := d.Update(ctx, existingPath, nextNodeObj)
+	newDag, err := d.update(ctx, batch, existingPath, nextNodeObj)
 	if err != nil {
 		return nil, fmt.Errorf("error updating DAG: %v", err)
 	}
@@ -735,3 +735,57 @@ func TestDagDelete(t *testing.T) {
 	}
 	assert.Equal(t, valCast, map[string]string{"name": "intermediary"})
 }
+
+// countingStore counts the reads and writes which reach the store
+type countingStore struct {
+	nodestore.DagStore
+	gets     int
+	adds     int
+	addManys int
+	nodes    int
+}
+
+func (cs *countingStore) Get(ctx context.Context, id cid.Cid) (format.Node, error) {
+	cs.gets++
+	return cs.DagStore.Get(ctx, id)
+}
+
+func (cs *countingStore) Add(ctx context.Context, n format.Node) error {
+	cs.adds++
+	return cs.DagStore.Add(ctx, n)
+}
+
+func (cs *countingStore) AddMany(ctx context.Context, nodes []format.Node) error {
+	cs.addManys++
+	cs.nodes += len(nodes)
+	return cs.DagStore.AddMany(ctx, nodes)
+}
+
+func TestMutationsAreBatched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+	store := &countingStore{DagStore: dag.Store}
+	dag = dag.WithNewTip(dag.Tip)
+	dag.Store = store
+
+	dag, err := dag.Set(ctx, []string{"a", "very", "deep", "new", "path"}, "value")
+	require.Nil(t, err)
+	assert.Equal(t, 0, store.adds)
+	assert.Equal(t, 1, store.addManys)
+
+	dag, err = dag.SetAsLink(ctx, []string{"child1", "deepChild1", "obj"}, map[string]string{"hi": "there"})
+	require.Nil(t, err)
+	assert.Equal(t, 0, store.adds)
+	assert.Equal(t, 2, store.addManys)
+
+	dag, err = dag.Delete(ctx, []string{"a", "very", "deep"})
+	require.Nil(t, err)
+	assert.Equal(t, 0, store.adds)
+	assert.Equal(t, 3, store.addManys)
+
+	val, _, err := dag.Resolve(ctx, []string{"child1", "deepChild1", "obj", "hi"})
+	require.Nil(t, err)
+	assert.Equal(t, "there", val)
+}
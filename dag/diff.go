@@ -0,0 +1,262 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ChangeType describes how the value at a path changed between two tips
+type ChangeType int
+
+const (
+	Added ChangeType = iota
+	Removed
+	Modified
+)
+
+func (ct ChangeType) String() string {
+	switch ct {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(ct))
+	}
+}
+
+// Change is a single difference reported by Diff. OldValue is nil for added paths and
+// NewValue is nil for removed ones. Values which are nodes are returned decoded (links
+// inside them are left as CIDs).
+type Change struct {
+	Type     ChangeType
+	Path     []string
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// Diff walks the tips of a and b and returns the changes needed to go from a to b, sorted
+// by path. Subtrees with identical CIDs are skipped, and a change is reported at the highest
+// point where one side has a value and the other doesn't or where the values are not both
+// objects. Sharded maps on both sides are compared node by node, so only the parts of them
+// which differ are loaded. Every link reached must be in its dag.
+func Diff(ctx context.Context, a, b *Dag) ([]*Change, error) {
+	var changes []*Change
+	root := func(d *Dag) diffEntry { return diffEntry{val: d.Tip, ok: true} }
+	err := diffValues(ctx, a, b, []string{}, root(a), root(b), func(path []string, aVal, bVal diffEntry) {
+		change := &Change{
+			Type:     Modified,
+			Path:     path,
+			OldValue: aVal.val,
+			NewValue: bVal.val,
+		}
+		switch {
+		case !aVal.ok:
+			change.Type = Added
+		case !bVal.ok:
+			change.Type = Removed
+		}
+		changes = append(changes, change)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return pathLess(changes[i].Path, changes[j].Path)
+	})
+	return changes, nil
+}
+
+// ChangedPaths returns the paths (sorted) whose values differ between the tips of a and b.
+// See Diff for the values themselves.
+func ChangedPaths(ctx context.Context, a, b *Dag) ([][]string, error) {
+	changes, err := Diff(ctx, a, b)
+	if err != nil {
+		return nil, err
+	}
+	var paths [][]string
+	for _, c := range changes {
+		paths = append(paths, c.Path)
+	}
+	return paths, nil
+}
+
+// pathLess orders paths key by key, so a path always sorts right before its children
+func pathLess(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// diffEntry is one side of a comparison, ok is false when there is no value at all
+// (which is different from a nil value)
+type diffEntry struct {
+	val interface{}
+	ok  bool
+}
+
+// diffValues calls onChange for every point where the values a and b (resolved from
+// their respective dags) differ
+func diffValues(ctx context.Context, aDag, bDag *Dag, path []string, a, b diffEntry, onChange func(path []string, a, b diffEntry)) error {
+	if aCid, ok := a.val.(cid.Cid); ok {
+		if bCid, ok := b.val.(cid.Cid); ok && aCid.Equals(bCid) {
+			return nil
+		}
+	}
+
+	aVal, aShard, err := loadLink(ctx, aDag, a.val)
+	if err != nil {
+		return err
+	}
+	bVal, bShard, err := loadLink(ctx, bDag, b.val)
+	if err != nil {
+		return err
+	}
+	if aShard != nil && bShard != nil {
+		return diffShardNodes(ctx, path, aShard, bShard, aShard.root, bShard.root, onChange)
+	}
+	if aShard != nil {
+		if aVal, err = aShard.toMap(ctx); err != nil {
+			return err
+		}
+	}
+	if bShard != nil {
+		if bVal, err = bShard.toMap(ctx); err != nil {
+			return err
+		}
+	}
+	a.val, b.val = aVal, bVal
+
+	aMap, aIsMap := aVal.(map[string]interface{})
+	bMap, bIsMap := bVal.(map[string]interface{})
+	if !a.ok || !b.ok || !aIsMap || !bIsMap {
+		if a.ok != b.ok || !reflect.DeepEqual(aVal, bVal) {
+			onChange(path, a, b)
+		}
+		return nil
+	}
+	return diffMaps(ctx, aDag, bDag, path, aMap, bMap, onChange)
+}
+
+func diffMaps(ctx context.Context, aDag, bDag *Dag, path []string, aMap, bMap map[string]interface{}, onChange func(path []string, a, b diffEntry)) error {
+	keys := make(map[string]struct{}, len(aMap)+len(bMap))
+	for k := range aMap {
+		keys[k] = struct{}{}
+	}
+	for k := range bMap {
+		keys[k] = struct{}{}
+	}
+	for k := range keys {
+		childPath := make([]string, len(path)+1)
+		copy(childPath, path)
+		childPath[len(path)] = k
+		aVal, aOk := aMap[k]
+		bVal, bOk := bMap[k]
+		err := diffValues(ctx, aDag, bDag, childPath, diffEntry{val: aVal, ok: aOk}, diffEntry{val: bVal, ok: bOk}, onChange)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffShardNodes compares two nodes of sharded maps pointer by pointer, see
+// eachChangedShardPointer
+func diffShardNodes(ctx context.Context, path []string, a, b *shard, aNode, bNode *shardNode, onChange func(path []string, a, b diffEntry)) error {
+	return eachChangedShardPointer(ctx, a, b, aNode, bNode, func(aEntries, bEntries map[string]interface{}) error {
+		return diffMaps(ctx, a.dag, b.dag, path, aEntries, bEntries, onChange)
+	})
+}
+
+// eachChangedShardPointer walks two nodes of sharded maps pointer by pointer and calls fn
+// with the entries under every pointer which differs. Keys always end up under the same
+// pointer, so pointers linking to the same CID are skipped without loading them.
+func eachChangedShardPointer(ctx context.Context, a, b *shard, aNode, bNode *shardNode, fn func(aEntries, bEntries map[string]interface{}) error) error {
+	for idx := 0; idx < 1<<shardBitWidth; idx++ {
+		bit := uint32(1) << uint(idx)
+		aPointer := aNode.pointer(bit)
+		bPointer := bNode.pointer(bit)
+		if aPointer == nil && bPointer == nil {
+			continue
+		}
+
+		if aPointer != nil && bPointer != nil && !aPointer.isBucket() && !bPointer.isBucket() {
+			if aPointer.Link != nil && bPointer.Link != nil && aPointer.Link.Equals(*bPointer.Link) {
+				continue
+			}
+			aChild, err := a.child(ctx, aPointer)
+			if err != nil {
+				return err
+			}
+			bChild, err := b.child(ctx, bPointer)
+			if err != nil {
+				return err
+			}
+			if err := eachChangedShardPointer(ctx, a, b, aChild, bChild, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		aEntries, err := a.pointerEntries(ctx, aPointer)
+		if err != nil {
+			return err
+		}
+		bEntries, err := b.pointerEntries(ctx, bPointer)
+		if err != nil {
+			return err
+		}
+		if err := fn(aEntries, bEntries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followLink returns the decoded node when val is a link and val itself otherwise.
+// Sharded maps are returned with all of their entries and links to nodes which are
+// missing from the store are an error.
+func followLink(ctx context.Context, d *Dag, val interface{}) (interface{}, error) {
+	obj, s, err := loadLink(ctx, d, val)
+	if err != nil || s == nil {
+		return obj, err
+	}
+	return s.toMap(ctx)
+}
+
+// loadLink is followLink but returns sharded maps as a shard (with a nil value) so
+// nothing more than their root is loaded
+func loadLink(ctx context.Context, d *Dag, val interface{}) (interface{}, *shard, error) {
+	id, ok := val.(cid.Cid)
+	if !ok {
+		return val, nil, nil
+	}
+	n, err := d.Get(ctx, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+	}
+	if n == nil {
+		return nil, nil, fmt.Errorf("node %s not found", id.String())
+	}
+	if isShardNode(n) {
+		s, err := d.loadShard(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, s, nil
+	}
+	obj, _, err := n.Resolve(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving node (%s): %v", n.Cid().String(), err)
+	}
+	return obj, nil, nil
+}
@@ -0,0 +1,158 @@
+package dag
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestChangedPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newDeepAndWideDag(t, ctx)
+
+	paths, err := ChangedPaths(ctx, a, a)
+	require.Nil(t, err)
+	assert.Len(t, paths, 0)
+
+	b, err := a.Set(ctx, []string{"child1", "deepChild1", "deepChild"}, false)
+	require.Nil(t, err)
+	b, err = b.Set(ctx, []string{"new", "path"}, "value")
+	require.Nil(t, err)
+	b, err = b.Delete(ctx, []string{"root"})
+	require.Nil(t, err)
+
+	paths, err = ChangedPaths(ctx, a, b)
+	require.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"child1", "deepChild1", "deepChild"},
+		{"new"},
+		{"root"},
+	}, paths)
+}
+
+func TestDiff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newDeepAndWideDag(t, ctx)
+
+	b, err := a.Set(ctx, []string{"child1", "deepChild1", "deepChild"}, false)
+	require.Nil(t, err)
+	b, err = b.Set(ctx, []string{"new", "path"}, "value")
+	require.Nil(t, err)
+	b, err = b.Delete(ctx, []string{"root"})
+	require.Nil(t, err)
+
+	changes, err := Diff(ctx, a, b)
+	require.Nil(t, err)
+	require.Len(t, changes, 3)
+
+	assert.Equal(t, &Change{
+		Type:     Modified,
+		Path:     []string{"child1", "deepChild1", "deepChild"},
+		OldValue: true,
+		NewValue: false,
+	}, changes[0])
+
+	assert.Equal(t, Added, changes[1].Type)
+	assert.Equal(t, []string{"new"}, changes[1].Path)
+	assert.Nil(t, changes[1].OldValue)
+	assert.Equal(t, map[string]interface{}{"path": "value"}, changes[1].NewValue)
+
+	assert.Equal(t, &Change{
+		Type:     Removed,
+		Path:     []string{"root"},
+		OldValue: true,
+	}, changes[2])
+
+	// the other way around swaps added and removed
+	changes, err = Diff(ctx, b, a)
+	require.Nil(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, Removed, changes[1].Type)
+	assert.Equal(t, Added, changes[2].Type)
+
+	t.Run("nil values are not missing values", func(t *testing.T) {
+		sw := &safewrap.SafeWrap{}
+		empty := sw.WrapObject(map[string]interface{}{})
+		nothing := sw.WrapObject(map[string]interface{}{"nothing": nil})
+		require.Nil(t, sw.Err)
+		a, err := NewDagWithNodes(ctx, a.Store, empty)
+		require.Nil(t, err)
+		withNil, err := NewDagWithNodes(ctx, a.Store, nothing)
+		require.Nil(t, err)
+
+		changes, err := Diff(ctx, a, withNil)
+		require.Nil(t, err)
+		require.Len(t, changes, 1)
+		assert.Equal(t, &Change{Type: Added, Path: []string{"nothing"}}, changes[0])
+
+		changes, err = Diff(ctx, withNil, a)
+		require.Nil(t, err)
+		require.Len(t, changes, 1)
+		assert.Equal(t, Removed, changes[0].Type)
+	})
+
+	t.Run("paths are sorted key by key", func(t *testing.T) {
+		c, err := a.Set(ctx, []string{"x/b"}, 1)
+		require.Nil(t, err)
+		c, err = c.Set(ctx, []string{"x", "c"}, 1)
+		require.Nil(t, err)
+		paths, err := ChangedPaths(ctx, a, c)
+		require.Nil(t, err)
+		assert.Equal(t, [][]string{{"x"}, {"x/b"}}, paths)
+	})
+
+	t.Run("missing nodes are an error", func(t *testing.T) {
+		sw := &safewrap.SafeWrap{}
+		missing := sw.WrapObject(map[string]interface{}{"not": "stored"})
+		require.Nil(t, sw.Err)
+		c, err := a.Set(ctx, []string{"missing"}, missing.Cid())
+		require.Nil(t, err)
+		_, err = Diff(ctx, a, c)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestDiffShards(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := &safewrap.SafeWrap{}
+	root := sw.WrapObject(map[string]interface{}{})
+	require.Nil(t, sw.Err)
+	store := &countingStore{DagStore: nodestore.MustMemoryStore(ctx)}
+	d, err := NewDagWithNodes(ctx, store, root)
+	require.Nil(t, err)
+	d, err = d.ShardMap(ctx, []string{"balances"})
+	require.Nil(t, err)
+	builder := d.NewBuilder()
+	for i := 0; i < 500; i++ {
+		require.Nil(t, builder.Set(ctx, []string{"balances", strconv.Itoa(i)}, i))
+	}
+	d, err = builder.Commit(ctx)
+	require.Nil(t, err)
+	changed, err := d.Set(ctx, []string{"balances", "1"}, "changed")
+	require.Nil(t, err)
+
+	nodes, err := d.Nodes(ctx)
+	require.Nil(t, err)
+
+	store.gets = 0
+	changes, err := Diff(ctx, d, changed)
+	require.Nil(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, []string{"balances", "1"}, changes[0].Path)
+	assert.Equal(t, 1, changes[0].OldValue)
+	assert.Equal(t, "changed", changes[0].NewValue)
+	// only the nodes on the way to the changed key are read
+	assert.Less(t, store.gets, len(nodes)/4)
+}
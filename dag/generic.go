@@ -0,0 +1,112 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// Get returns the value at path as a T. Linked nodes are decoded straight from their cbor
+// so structs (registered with cbornode.RegisterCborType) come back exactly as they were
+// stored, asking for a cid.Cid returns the link itself. Inline values are returned as is
+// when they already are a T and converted through cbor otherwise (e.g. an int into a
+// uint64). A path with nothing at it returns format.ErrNotFound.
+func Get[T any](ctx context.Context, d *Dag, path []string) (T, error) {
+	var out T
+
+	val, err := d.valueAt(ctx, path)
+	if err != nil {
+		return out, err
+	}
+
+	if id, ok := val.(cid.Cid); ok {
+		if _, wantsLink := interface{}(out).(cid.Cid); wantsLink {
+			return interface{}(id).(T), nil
+		}
+		n, err := d.Get(ctx, id)
+		if err != nil {
+			return out, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+		}
+		if n == nil {
+			return out, format.ErrNotFound
+		}
+		if !isShardNode(n) {
+			err = cbornode.DecodeInto(n.RawData(), &out)
+			if err != nil {
+				return out, fmt.Errorf("error decoding %v into %T: %v", path, out, err)
+			}
+			return out, nil
+		}
+		val, err = d.nodeValue(ctx, n)
+		if err != nil {
+			return out, err
+		}
+	}
+
+	if typed, ok := val.(T); ok {
+		return typed, nil
+	}
+	encoded, err := cbornode.DumpObject(val)
+	if err != nil {
+		return out, fmt.Errorf("error encoding value at %v: %v", path, err)
+	}
+	err = cbornode.DecodeInto(encoded, &out)
+	if err != nil {
+		return out, fmt.Errorf("error converting %v (%T) into %T: %v", path, val, out, err)
+	}
+	return out, nil
+}
+
+// Put sets val at path and returns the new Dag. Structs, maps and anything else which
+// Set won't take are stored as their own node like SetAsLink does.
+func Put[T any](ctx context.Context, d *Dag, path []string, val T) (*Dag, error) {
+	if isComplexObj(val) {
+		return d.SetAsLink(ctx, path, val)
+	}
+	return d.Set(ctx, path, val)
+}
+
+// valueAt returns the value at path without following a link at its end. A sharded
+// parent only has the nodes on the way to the key loaded.
+func (d *Dag) valueAt(ctx context.Context, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return d.Tip, nil
+	}
+
+	parentPath := path[:len(path)-1]
+	parent, remaining, err := d.resolve(ctx, parentPath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %v: %v", parentPath, err)
+	}
+	if len(remaining) > 0 {
+		return nil, format.ErrNotFound
+	}
+
+	key := path[len(path)-1]
+	var val interface{}
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		val = parent[key]
+	case *shard:
+		entry, err := parent.get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting %s from sharded map: %v", key, err)
+		}
+		if entry != nil {
+			val = entry.Value
+		}
+	case []interface{}:
+		idx, err := listIndex(key, len(parent))
+		if err != nil {
+			return nil, format.ErrNotFound
+		}
+		val = parent[idx]
+	}
+	if val == nil {
+		return nil, format.ErrNotFound
+	}
+	return val, nil
+}
@@ -0,0 +1,109 @@
+package dag
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAndPut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+
+	dag, err := Put(ctx, dag, []string{"child1", "struct"}, &dagTestStruct{Height: math.MaxUint64})
+	require.Nil(t, err)
+	dag, err = Put(ctx, dag, []string{"child1", "count"}, 42)
+	require.Nil(t, err)
+	dag, err = Put(ctx, dag, []string{"child1", "names"}, []string{"a", "b"})
+	require.Nil(t, err)
+
+	// linked nodes decode exactly, even where the generic form can't
+	typed, err := Get[*dagTestStruct](ctx, dag, []string{"child1", "struct"})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), typed.Height)
+	value, err := Get[dagTestStruct](ctx, dag, []string{"child1", "struct"})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), value.Height)
+
+	link, err := Get[cid.Cid](ctx, dag, []string{"child1", "struct"})
+	require.Nil(t, err)
+	assert.True(t, link.Defined())
+
+	count, err := Get[uint64](ctx, dag, []string{"child1", "count"})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(42), count)
+	intCount, err := Get[int](ctx, dag, []string{"child1", "count"})
+	require.Nil(t, err)
+	assert.Equal(t, 42, intCount)
+
+	names, err := Get[[]string](ctx, dag, []string{"child1", "names"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, names)
+	name, err := Get[string](ctx, dag, []string{"child1", "names", "1"})
+	require.Nil(t, err)
+	assert.Equal(t, "b", name)
+
+	obj, err := Get[map[string]interface{}](ctx, dag, []string{"child1", "deepChild1"})
+	require.Nil(t, err)
+	assert.Equal(t, true, obj["deepChild"])
+
+	t.Run("missing paths", func(t *testing.T) {
+		for _, path := range [][]string{
+			{"child1", "missing"},
+			{"missing", "deeper"},
+			{"child1", "count", "deeper"},
+			{"child1", "names", "5"},
+		} {
+			_, err := Get[string](ctx, dag, path)
+			assert.Equal(t, format.ErrNotFound, err, "path %v", path)
+		}
+	})
+
+	t.Run("type mismatches", func(t *testing.T) {
+		_, err := Get[string](ctx, dag, []string{"child1", "count"})
+		assert.NotNil(t, err)
+		_, err = Get[bool](ctx, dag, []string{"child1", "names"})
+		assert.NotNil(t, err)
+		_, err = Get[[]string](ctx, dag, []string{"child1", "struct"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("sharded maps", func(t *testing.T) {
+		sharded, err := dag.ShardMap(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+		sharded, err = Put(ctx, sharded, []string{"child1", "balances", "alice"}, uint64(10))
+		require.Nil(t, err)
+
+		balance, err := Get[uint64](ctx, sharded, []string{"child1", "balances", "alice"})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(10), balance)
+		balances, err := Get[map[string]uint64](ctx, sharded, []string{"child1", "balances"})
+		require.Nil(t, err)
+		assert.Equal(t, map[string]uint64{"alice": 10}, balances)
+
+		builder := sharded.NewBuilder()
+		for i := 0; i < 500; i++ {
+			require.Nil(t, builder.Set(ctx, []string{"child1", "balances", strconv.Itoa(i)}, i))
+		}
+		sharded, err = builder.Commit(ctx)
+		require.Nil(t, err)
+		nodes, err := sharded.Nodes(ctx)
+		require.Nil(t, err)
+
+		// only the nodes on the way to the key are read
+		store := &countingStore{DagStore: sharded.Store}
+		counted := NewDag(ctx, sharded.Tip, store)
+		balance, err = Get[uint64](ctx, counted, []string{"child1", "balances", "alice"})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(10), balance)
+		assert.Less(t, store.gets, len(nodes)/4)
+	})
+}
@@ -0,0 +1,381 @@
+package dag
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	refmtcbor "github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/tok"
+
+	"github.com/quorumcontrol/chaintree/nodestore"
+)
+
+// ExportJSON returns the value at path as DAG-JSON style JSON. Links are written as
+// {"/": "<cid>"} and bytes as {"/": {"bytes": "<base64>"}}. With inline set linked nodes
+// are replaced by their (exported) contents instead, links to nodes missing from the store
+// are still written as links. Object keys are sorted so the output is deterministic.
+func (d *Dag) ExportJSON(ctx context.Context, path []string, inline bool) ([]byte, error) {
+	// the path is resolved here rather than with Resolve so that nodes are decoded with
+	// decodeJSONNode, which keeps integers too large for an int intact
+	var val interface{} = d.Tip
+	for _, key := range path {
+		var err error
+		val, err = d.followJSONLink(ctx, val)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		switch container := val.(type) {
+		case map[string]interface{}:
+			val, ok = container[key]
+		case []interface{}:
+			idx, err := listIndex(key, len(container))
+			if ok = err == nil; ok {
+				val = container[idx]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("path not found: %v", path)
+		}
+	}
+	val, err := d.followJSONLink(ctx, val)
+	if err != nil {
+		return nil, err
+	}
+
+	exported, err := d.toJSONValue(ctx, val, inline)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(exported)
+}
+
+func (d *Dag) toJSONValue(ctx context.Context, val interface{}, inline bool) (interface{}, error) {
+	switch val := val.(type) {
+	case cid.Cid:
+		if !inline {
+			return map[string]interface{}{"/": val.String()}, nil
+		}
+		obj, err := d.followJSONLink(ctx, val)
+		if err != nil {
+			return nil, err
+		}
+		if _, missing := obj.(cid.Cid); missing {
+			return map[string]interface{}{"/": val.String()}, nil
+		}
+		return d.toJSONValue(ctx, obj, inline)
+	case *format.Link:
+		return d.toJSONValue(ctx, val.Cid, inline)
+	case []byte:
+		return map[string]interface{}{"/": map[string]interface{}{"bytes": base64.RawStdEncoding.EncodeToString(val)}}, nil
+	case float32:
+		return jsonFloat(float64(val))
+	case float64:
+		return jsonFloat(val)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			converted, err := d.toJSONValue(ctx, v, inline)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = converted
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, v := range val {
+			converted, err := d.toJSONValue(ctx, v, inline)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = converted
+		}
+		return out, nil
+	default:
+		return val, nil
+	}
+}
+
+// followJSONLink returns the decoded node when val is a link and val itself otherwise
+// (also for links to nodes missing from the store). Sharded maps are returned with all
+// of their entries.
+func (d *Dag) followJSONLink(ctx context.Context, val interface{}) (interface{}, error) {
+	id, ok := val.(cid.Cid)
+	if !ok {
+		return val, nil
+	}
+	n, err := d.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+	}
+	if n == nil {
+		return val, nil
+	}
+	obj, err := decodeJSONNode(n.RawData())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding node (%s): %v", id.String(), err)
+	}
+	if !isShardNode(n) {
+		return obj, nil
+	}
+	entries := make(map[string]interface{})
+	err = d.shardJSONEntries(ctx, obj, entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// shardJSONEntries adds the entries of the decoded shard node to entries, following the
+// links to its child nodes
+func (d *Dag) shardJSONEntries(ctx context.Context, node interface{}, entries map[string]interface{}) error {
+	obj, _ := node.(map[string]interface{})
+	pointers, _ := obj["pointers"].([]interface{})
+	for _, p := range pointers {
+		pointer, _ := p.(map[string]interface{})
+		if link, ok := pointer["link"].(cid.Cid); ok {
+			n, err := d.Get(ctx, link)
+			if err != nil {
+				return fmt.Errorf("error getting shard (%s): %v", link.String(), err)
+			}
+			if n == nil {
+				return fmt.Errorf("shard %s not found", link.String())
+			}
+			child, err := decodeJSONNode(n.RawData())
+			if err != nil {
+				return fmt.Errorf("error decoding shard (%s): %v", link.String(), err)
+			}
+			if err := d.shardJSONEntries(ctx, child, entries); err != nil {
+				return err
+			}
+			continue
+		}
+		bucket, _ := pointer["entries"].([]interface{})
+		for _, e := range bucket {
+			entry, _ := e.(map[string]interface{})
+			key, ok := entry["key"].(string)
+			if !ok {
+				return fmt.Errorf("invalid shard entry: %v", e)
+			}
+			entries[key] = entry["value"]
+		}
+	}
+	return nil
+}
+
+// decodeJSONNode decodes raw CBOR like the nodes do, except that unsigned integers too
+// large for an int are kept as uint64 instead of wrapping around to negative ints
+func decodeJSONNode(raw []byte) (interface{}, error) {
+	decoder := refmtcbor.NewDecoder(refmtcbor.DecodeOptions{}, bytes.NewReader(raw))
+	var next func() (interface{}, bool, error)
+	next = func() (interface{}, bool, error) {
+		var t tok.Token
+		if _, err := decoder.Step(&t); err != nil {
+			return nil, false, err
+		}
+		switch t.Type {
+		case tok.TMapOpen:
+			obj := make(map[string]interface{})
+			for {
+				key, end, err := next()
+				if err != nil || end {
+					return obj, false, err
+				}
+				k, ok := key.(string)
+				if !ok {
+					return nil, false, fmt.Errorf("map key %v is not a string", key)
+				}
+				val, _, err := next()
+				if err != nil {
+					return nil, false, err
+				}
+				obj[k] = val
+			}
+		case tok.TArrOpen:
+			list := []interface{}{}
+			for {
+				val, end, err := next()
+				if err != nil || end {
+					return list, false, err
+				}
+				list = append(list, val)
+			}
+		case tok.TMapClose, tok.TArrClose:
+			return nil, true, nil
+		case tok.TNull:
+			return nil, false, nil
+		case tok.TString:
+			return t.Str, false, nil
+		case tok.TBytes:
+			if t.Tagged && t.Tag == cbornode.CBORTagLink {
+				if len(t.Bytes) == 0 || t.Bytes[0] != 0 {
+					return nil, false, fmt.Errorf("invalid link")
+				}
+				id, err := cid.Cast(t.Bytes[1:])
+				return id, false, err
+			}
+			return t.Bytes, false, nil
+		case tok.TBool:
+			return t.Bool, false, nil
+		case tok.TInt:
+			return int(t.Int), false, nil
+		case tok.TUint:
+			if t.Uint > math.MaxInt64 {
+				return t.Uint, false, nil
+			}
+			return int(t.Uint), false, nil
+		case tok.TFloat64:
+			return t.Float64, false, nil
+		default:
+			return nil, false, fmt.Errorf("unexpected token %v", t)
+		}
+	}
+	val, _, err := next()
+	return val, err
+}
+
+// jsonFloat writes floats so they are never read back as integers, 1.0 is written as
+// "1.0" rather than "1"
+func jsonFloat(f float64) (interface{}, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, fmt.Errorf("%v can not be written as JSON", f)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return json.Number(s), nil
+}
+
+// ImportJSON builds a new Dag in store from JSON as written by ExportJSON. The top level
+// object becomes the root node and only {"/": "<cid>"} links point to other nodes, every
+// other object is kept inline in the node holding it. Importing an export made without
+// inline therefore gives the same tip again (as long as the linked nodes are in store),
+// while an inlined export comes back with the same values in a single node. Numbers with
+// a fraction or exponent are floats and every other number an integer, which is an error
+// when it doesn't fit into 64 bits. Links are kept as links, the nodes they point to are
+// not checked.
+func ImportJSON(ctx context.Context, store nodestore.DagStore, data []byte) (*Dag, error) {
+	root, err := DecodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := root.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("JSON must be an object to import as a dag, got %T", root)
+	}
+	if err := checkReserved(nil, root); err != nil {
+		return nil, err
+	}
+
+	d := &Dag{Store: store}
+	n, err := d.CreateNode(ctx, root)
+	if err != nil {
+		return nil, fmt.Errorf("error creating node: %v", err)
+	}
+	d.Tip = n.Cid()
+	return d, nil
+}
+
+// DecodeJSON decodes a single JSON value the way ImportJSON does (without creating any
+// nodes), so the result can be used with Set
+func DecodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var val interface{}
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	return fromJSONValue(val)
+}
+
+// fromJSONValue converts decoded JSON into the values of a node
+func fromJSONValue(val interface{}) (interface{}, error) {
+	switch val := val.(type) {
+	case json.Number:
+		return fromJSONNumber(val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, v := range val {
+			converted, err := fromJSONValue(v)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = converted
+		}
+		return out, nil
+	case map[string]interface{}:
+		if special, ok, err := fromJSONSpecial(val); ok || err != nil {
+			return special, err
+		}
+		obj := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			converted, err := fromJSONValue(v)
+			if err != nil {
+				return nil, err
+			}
+			obj[k] = converted
+		}
+		return obj, nil
+	default:
+		return val, nil
+	}
+}
+
+// fromJSONNumber returns a float64 for numbers with a fraction or exponent and an
+// int64 (or uint64 when it's too large for an int64) for anything else
+func fromJSONNumber(n json.Number) (interface{}, error) {
+	s := n.String()
+	if strings.ContainsAny(s, ".eE") {
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding number %s: %v", s, err)
+		}
+		return f, nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	u, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding number %s: does not fit into 64 bits", s)
+	}
+	return u, nil
+}
+
+// fromJSONSpecial decodes the {"/": ...} forms used for links and bytes
+func fromJSONSpecial(obj map[string]interface{}) (interface{}, bool, error) {
+	if len(obj) != 1 {
+		return nil, false, nil
+	}
+	switch slash := obj["/"].(type) {
+	case string:
+		id, err := cid.Decode(slash)
+		if err != nil {
+			return nil, true, fmt.Errorf("error decoding link %s: %v", slash, err)
+		}
+		return id, true, nil
+	case map[string]interface{}:
+		encoded, ok := slash["bytes"].(string)
+		if !ok || len(slash) != 1 {
+			return nil, false, nil
+		}
+		b, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, true, fmt.Errorf("error decoding bytes: %v", err)
+		}
+		return b, true, nil
+	default:
+		return nil, false, nil
+	}
+}
@@ -0,0 +1,89 @@
+package dag
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/quorumcontrol/chaintree/nodestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+	dag, err := dag.Set(ctx, []string{"data", "number"}, 42)
+	require.Nil(t, err)
+	dag, err = dag.Set(ctx, []string{"data", "bytes"}, []byte("hi"))
+	require.Nil(t, err)
+
+	linked, err := dag.ExportJSON(ctx, []string{"child1"}, false)
+	require.Nil(t, err)
+	assert.Equal(t, `{"child1":true,"deepChild1":{"/":"bafyreidrg54cnkitakzboabdovu5sgp4ccd5znwi7s3q37nzcpy6oriztu"}}`, string(linked))
+
+	inlined, err := dag.ExportJSON(ctx, []string{"child1"}, true)
+	require.Nil(t, err)
+	assert.Equal(t, `{"child1":true,"deepChild1":{"deepChild":true}}`, string(inlined))
+
+	val, err := dag.ExportJSON(ctx, []string{"data", "number"}, true)
+	require.Nil(t, err)
+	assert.Equal(t, `42`, string(val))
+
+	_, err = dag.ExportJSON(ctx, []string{"nope"}, true)
+	require.NotNil(t, err)
+
+	t.Run("round trips", func(t *testing.T) {
+		dag, err := dag.SetAsLink(ctx, []string{"data", "numbers"}, map[string]interface{}{
+			"nested": map[string]interface{}{"inline": true},
+			"max":    uint64(math.MaxUint64),
+			"min":    int64(math.MinInt64),
+			"float":  1.0,
+			"half":   1.5,
+		})
+		require.Nil(t, err)
+
+		// without inline the exact dag comes back (the linked nodes are already there)
+		exported, err := dag.ExportJSON(ctx, nil, false)
+		require.Nil(t, err)
+		imported, err := ImportJSON(ctx, dag.Store, exported)
+		require.Nil(t, err)
+		assert.True(t, dag.Tip.Equals(imported.Tip))
+
+		// an inlined export comes back as a single node with the same values
+		inlined, err := dag.ExportJSON(ctx, nil, true)
+		require.Nil(t, err)
+		imported, err = ImportJSON(ctx, nodestore.MustMemoryStore(ctx), inlined)
+		require.Nil(t, err)
+		reexported, err := imported.ExportJSON(ctx, nil, true)
+		require.Nil(t, err)
+		assert.JSONEq(t, string(inlined), string(reexported))
+		nodes, err := imported.Nodes(ctx)
+		require.Nil(t, err)
+		assert.Len(t, nodes, 1)
+
+		b, _, err := imported.Resolve(ctx, []string{"data", "bytes"})
+		require.Nil(t, err)
+		assert.Equal(t, []byte("hi"), b)
+
+		numbers, err := imported.ExportJSON(ctx, []string{"data", "numbers"}, true)
+		require.Nil(t, err)
+		assert.Equal(t, `{"float":1.0,"half":1.5,"max":18446744073709551615,"min":-9223372036854775808,"nested":{"inline":true}}`, string(numbers))
+
+		val, _, err := imported.Resolve(ctx, []string{"data", "numbers", "float"})
+		require.Nil(t, err)
+		assert.Equal(t, 1.0, val)
+	})
+
+	t.Run("bad input", func(t *testing.T) {
+		store := nodestore.MustMemoryStore(ctx)
+		_, err := ImportJSON(ctx, store, []byte(`[1, 2]`))
+		assert.NotNil(t, err)
+		_, err = ImportJSON(ctx, store, []byte(`{"link": {"/": "notacid"}}`))
+		assert.NotNil(t, err)
+		_, err = ImportJSON(ctx, store, []byte(`{"big": 18446744073709551616}`))
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,90 @@
+package dag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+
+	dag, err := dag.Append(ctx, []string{"child1", "items"}, "first")
+	require.Nil(t, err)
+	dag, err = dag.AppendAsLink(ctx, []string{"child1", "items"}, map[string]interface{}{"name": "second"})
+	require.Nil(t, err)
+	dag, err = dag.Insert(ctx, []string{"child1", "items"}, 0, "zeroth")
+	require.Nil(t, err)
+
+	for _, test := range []struct {
+		path     []string
+		expected interface{}
+	}{
+		{path: []string{"child1", "items", "0"}, expected: "zeroth"},
+		{path: []string{"child1", "items", "1"}, expected: "first"},
+		// through a link in the list
+		{path: []string{"child1", "items", "2", "name"}, expected: "second"},
+		{path: []string{"child1", "items", "3"}, expected: nil},
+	} {
+		val, _, err := dag.Resolve(ctx, test.path)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, val, "path %v", test.path)
+	}
+
+	dag, err = dag.Set(ctx, []string{"child1", "items", "2", "name"}, "changed")
+	require.Nil(t, err)
+	dag, err = dag.Set(ctx, []string{"child1", "items", "1"}, "replaced")
+	require.Nil(t, err)
+	_, err = dag.Set(ctx, []string{"child1", "items", "5"}, "out of range")
+	require.NotNil(t, err)
+
+	items, _, err := dag.Resolve(ctx, []string{"child1", "items"})
+	require.Nil(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, "replaced", items.([]interface{})[1])
+	name, _, err := dag.Resolve(ctx, []string{"child1", "items", "2", "name"})
+	require.Nil(t, err)
+	assert.Equal(t, "changed", name)
+
+	// the rest of the tree is untouched
+	val, _, err := dag.Resolve(ctx, []string{"child1", "deepChild1", "deepChild"})
+	require.Nil(t, err)
+	assert.Equal(t, true, val)
+
+	deleted, err := dag.Delete(ctx, []string{"child1", "items", "0"})
+	require.Nil(t, err)
+	items, _, err = deleted.Resolve(ctx, []string{"child1", "items"})
+	require.Nil(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "replaced", items.([]interface{})[0])
+
+	// lists of plain values can be set directly
+	_, err = dag.Set(ctx, []string{"list"}, []interface{}{1, "two", true})
+	require.Nil(t, err)
+	_, err = dag.Set(ctx, []string{"list"}, []interface{}{map[string]string{}})
+	require.NotNil(t, err)
+
+	_, err = dag.Append(ctx, []string{"child1", "child1"}, "not a list")
+	require.NotNil(t, err)
+	_, err = dag.Insert(ctx, []string{"child1", "items"}, 10, "out of range")
+	require.NotNil(t, err)
+
+	t.Run("in a builder", func(t *testing.T) {
+		builder := dag.NewBuilder()
+		require.Nil(t, builder.Set(ctx, []string{"child1", "items", "2", "name"}, "built"))
+		require.Nil(t, builder.Delete(ctx, []string{"child1", "items", "0"}))
+		built, err := builder.Commit(ctx)
+		require.Nil(t, err)
+
+		expected, err := dag.Set(ctx, []string{"child1", "items", "2", "name"}, "built")
+		require.Nil(t, err)
+		expected, err = expected.Delete(ctx, []string{"child1", "items", "0"})
+		require.Nil(t, err)
+		assert.True(t, expected.Tip.Equals(built.Tip))
+	})
+}
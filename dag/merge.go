@@ -0,0 +1,275 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// ConflictResolver is called by Merge for a path which was changed differently on both
+// sides. It gets the (decoded) values from the common ancestor, ours and theirs, any of
+// which may be nil when the path doesn't exist there, and returns the merged value.
+// Returning nil removes the path.
+type ConflictResolver func(path []string, base, ours, theirs interface{}) (interface{}, error)
+
+// OursResolver resolves every conflict by keeping our value
+func OursResolver(_ []string, _, ours, _ interface{}) (interface{}, error) {
+	return ours, nil
+}
+
+// TheirsResolver resolves every conflict by keeping their value
+func TheirsResolver(_ []string, _, _, theirs interface{}) (interface{}, error) {
+	return theirs, nil
+}
+
+// ConflictError is returned from Merge when there is a conflict and no resolver
+type ConflictError struct {
+	Path []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge conflict at path %v", e.Path)
+}
+
+// Merge does a three-way merge of ours and theirs, which both descend from base, and returns
+// a new Dag on ours' store. Subtrees which are identical (same CID) on two of the three
+// sides are taken as is, maps changed on both sides are merged key by key and
+// anything else changed on both sides goes to the resolver (a nil resolver makes
+// conflicts return a *ConflictError). Maps which are sharded in ours stay sharded and only
+// get the entries which theirs changed set, so just the nodes of the map on the way to
+// those are rewritten. The nodes of theirs have to be available in ours' store. Every new
+// node is written in a single batch.
+func Merge(ctx context.Context, base, ours, theirs *Dag, resolver ConflictResolver) (*Dag, error) {
+	return ours.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+		m := &merger{
+			base:     base,
+			ours:     ours,
+			theirs:   theirs,
+			resolver: resolver,
+			batch:    batch,
+		}
+		merged, err := m.merge(ctx, []string{}, base.Tip, ours.Tip, theirs.Tip)
+		if err != nil {
+			return nil, err
+		}
+		tip, ok := merged.(cid.Cid)
+		if !ok {
+			return nil, fmt.Errorf("error merging: root resolved to a non-node value %v", merged)
+		}
+		return ours.WithNewTip(tip), nil
+	})
+}
+
+type merger struct {
+	base     *Dag
+	ours     *Dag
+	theirs   *Dag
+	resolver ConflictResolver
+	batch    *format.Batch
+}
+
+// merge works on the raw values (links are still CIDs) so that identical subtrees
+// never get loaded
+func (m *merger) merge(ctx context.Context, path []string, base, ours, theirs interface{}) (interface{}, error) {
+	switch {
+	case sameValue(ours, theirs):
+		return ours, nil
+	case sameValue(base, ours):
+		return theirs, nil
+	case sameValue(base, theirs):
+		return ours, nil
+	}
+
+	baseVal, baseShard, err := loadLink(ctx, m.base, base)
+	if err != nil {
+		return nil, err
+	}
+	oursVal, oursShard, err := loadLink(ctx, m.ours, ours)
+	if err != nil {
+		return nil, err
+	}
+	theirsVal, theirsShard, err := loadLink(ctx, m.theirs, theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	if oursShard != nil && (theirsShard != nil || isMap(theirsVal)) {
+		return m.mergeShard(ctx, path, baseVal, baseShard, oursShard, theirsVal, theirsShard)
+	}
+
+	if oursVal, err = shardMap(ctx, oursVal, oursShard); err != nil {
+		return nil, err
+	}
+	if theirsVal, err = shardMap(ctx, theirsVal, theirsShard); err != nil {
+		return nil, err
+	}
+	if baseVal, err = shardMap(ctx, baseVal, baseShard); err != nil {
+		return nil, err
+	}
+
+	oursMap, oursIsMap := oursVal.(map[string]interface{})
+	theirsMap, theirsIsMap := theirsVal.(map[string]interface{})
+	if !oursIsMap || !theirsIsMap {
+		return m.resolve(ctx, path, baseVal, oursVal, theirsVal)
+	}
+	baseMap, ok := baseVal.(map[string]interface{})
+	if !ok {
+		baseMap = make(map[string]interface{})
+	}
+
+	keys := make(map[string]struct{}, len(oursMap)+len(theirsMap))
+	for _, obj := range []map[string]interface{}{baseMap, oursMap, theirsMap} {
+		for k := range obj {
+			keys[k] = struct{}{}
+		}
+	}
+
+	merged := make(map[string]interface{}, len(keys))
+	for k := range keys {
+		val, err := m.merge(ctx, childPath(path, k), baseMap[k], oursMap[k], theirsMap[k])
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			merged[k] = val
+		}
+	}
+
+	_, oursIsLink := ours.(cid.Cid)
+	_, theirsIsLink := theirs.(cid.Cid)
+	if !oursIsLink && !theirsIsLink {
+		return merged, nil
+	}
+	return m.link(ctx, merged)
+}
+
+// mergeShard merges the changes theirs made to base into the sharded map of ours one
+// entry at a time. When base and theirs are both sharded only the parts of them which
+// differ are loaded.
+func (m *merger) mergeShard(ctx context.Context, path []string, baseVal interface{}, baseShard, ours *shard, theirsVal interface{}, theirsShard *shard) (interface{}, error) {
+	// the entries theirs changed, ok is false on the side which doesn't have the key
+	type change struct {
+		base, theirs diffEntry
+	}
+	changes := make(map[string]*change)
+	collect := func(baseEntries, theirsEntries map[string]interface{}) error {
+		for k, v := range baseEntries {
+			if theirsV, ok := theirsEntries[k]; !ok || !sameValue(v, theirsV) {
+				changes[k] = &change{base: diffEntry{val: v, ok: true}, theirs: diffEntry{val: theirsV, ok: ok}}
+			}
+		}
+		for k, v := range theirsEntries {
+			if _, ok := baseEntries[k]; !ok {
+				changes[k] = &change{theirs: diffEntry{val: v, ok: true}}
+			}
+		}
+		return nil
+	}
+
+	if baseShard != nil && theirsShard != nil {
+		if err := eachChangedShardPointer(ctx, baseShard, theirsShard, baseShard.root, theirsShard.root, collect); err != nil {
+			return nil, err
+		}
+	} else {
+		baseMap, err := shardMap(ctx, baseVal, baseShard)
+		if err != nil {
+			return nil, err
+		}
+		theirsMap, err := shardMap(ctx, theirsVal, theirsShard)
+		if err != nil {
+			return nil, err
+		}
+		baseEntries, _ := baseMap.(map[string]interface{})
+		theirsEntries, _ := theirsMap.(map[string]interface{})
+		if err := collect(baseEntries, theirsEntries); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, c := range changes {
+		entry, err := ours.get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		var oursV interface{}
+		if entry != nil {
+			oursV = entry.Value
+		}
+		val, err := m.merge(ctx, childPath(path, k), c.base.val, oursV, c.theirs.val)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case val == nil && entry != nil:
+			if _, err := ours.delete(ctx, k); err != nil {
+				return nil, err
+			}
+		case val != nil && (entry == nil || !sameValue(val, oursV)):
+			if err := ours.set(ctx, k, val); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	id, _, err := ours.write(ctx, m.batch, nil)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (m *merger) resolve(ctx context.Context, path []string, base, ours, theirs interface{}) (interface{}, error) {
+	if m.resolver == nil {
+		return nil, &ConflictError{Path: path}
+	}
+	val, err := m.resolver(path, base, ours, theirs)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving conflict at path %v: %v", path, err)
+	}
+	if err := checkReserved(path, val); err != nil {
+		return nil, err
+	}
+	if _, ok := val.(map[string]interface{}); ok {
+		return m.link(ctx, val)
+	}
+	return val, nil
+}
+
+func (m *merger) link(ctx context.Context, obj interface{}) (interface{}, error) {
+	n, err := m.ours.createNode(ctx, m.batch, obj)
+	if err != nil {
+		return nil, fmt.Errorf("error creating node: %v", err)
+	}
+	return n.Cid(), nil
+}
+
+// shardMap returns all the entries of s when it isn't nil and val otherwise
+func shardMap(ctx context.Context, val interface{}, s *shard) (interface{}, error) {
+	if s == nil {
+		return val, nil
+	}
+	return s.toMap(ctx)
+}
+
+func isMap(val interface{}) bool {
+	_, ok := val.(map[string]interface{})
+	return ok
+}
+
+func childPath(path []string, key string) []string {
+	child := make([]string, len(path)+1)
+	copy(child, path)
+	child[len(path)] = key
+	return child
+}
+
+func sameValue(a, b interface{}) bool {
+	if aCid, ok := a.(cid.Cid); ok {
+		bCid, ok := b.(cid.Cid)
+		return ok && aCid.Equals(bCid)
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,108 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := newDeepAndWideDag(t, ctx)
+
+	ours, err := base.Set(ctx, []string{"child1", "deepChild1", "deepChild"}, false)
+	require.Nil(t, err)
+	ours, err = ours.Set(ctx, []string{"ours"}, "value")
+	require.Nil(t, err)
+
+	theirs, err := base.Set(ctx, []string{"child1", "child1"}, false)
+	require.Nil(t, err)
+	theirs, err = theirs.Delete(ctx, []string{"root"})
+	require.Nil(t, err)
+
+	merged, err := Merge(ctx, base, ours, theirs, nil)
+	require.Nil(t, err)
+
+	for _, test := range []struct {
+		path     []string
+		expected interface{}
+	}{
+		{path: []string{"child1", "deepChild1", "deepChild"}, expected: false},
+		{path: []string{"child1", "child1"}, expected: false},
+		{path: []string{"child2", "deepChild2", "deepChild"}, expected: true},
+		{path: []string{"ours"}, expected: "value"},
+		{path: []string{"root"}, expected: nil},
+	} {
+		val, _, err := merged.Resolve(ctx, test.path)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, val, "path %v", test.path)
+	}
+
+	// merging with an unchanged side is a fast forward
+	merged, err = Merge(ctx, base, base, theirs, nil)
+	require.Nil(t, err)
+	assert.True(t, merged.Tip.Equals(theirs.Tip))
+
+	t.Run("conflicts", func(t *testing.T) {
+		ours, err := base.Set(ctx, []string{"child1", "child1"}, "ours")
+		require.Nil(t, err)
+		theirs, err := base.Set(ctx, []string{"child1", "child1"}, "theirs")
+		require.Nil(t, err)
+
+		_, err = Merge(ctx, base, ours, theirs, nil)
+		require.NotNil(t, err)
+		conflict, ok := err.(*ConflictError)
+		require.True(t, ok)
+		assert.Equal(t, []string{"child1", "child1"}, conflict.Path)
+
+		merged, err := Merge(ctx, base, ours, theirs, TheirsResolver)
+		require.Nil(t, err)
+		assert.True(t, merged.Tip.Equals(theirs.Tip))
+
+		merged, err = Merge(ctx, base, ours, theirs, func(path []string, base, ours, theirs interface{}) (interface{}, error) {
+			return ours.(string) + "+" + theirs.(string), nil
+		})
+		require.Nil(t, err)
+		val, _, err := merged.Resolve(ctx, []string{"child1", "child1"})
+		require.Nil(t, err)
+		assert.Equal(t, "ours+theirs", val)
+	})
+
+	t.Run("sharded maps", func(t *testing.T) {
+		base, err := base.ShardMap(ctx, []string{"sharded"})
+		require.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			base, err = base.Set(ctx, []string{"sharded", fmt.Sprintf("key%d", i)}, i)
+			require.Nil(t, err)
+		}
+
+		ours, err := base.Set(ctx, []string{"sharded", "key1"}, "ours")
+		require.Nil(t, err)
+		theirs, err := base.Set(ctx, []string{"sharded", "key2"}, "theirs")
+		require.Nil(t, err)
+		theirs, err = theirs.Delete(ctx, []string{"sharded", "key3"})
+		require.Nil(t, err)
+
+		expected, err := ours.Set(ctx, []string{"sharded", "key2"}, "theirs")
+		require.Nil(t, err)
+		expected, err = expected.Delete(ctx, []string{"sharded", "key3"})
+		require.Nil(t, err)
+
+		store := &countingStore{DagStore: ours.Store}
+		counted := ours.WithNewTip(ours.Tip)
+		counted.Store = store
+
+		merged, err := Merge(ctx, base, counted, theirs, nil)
+		require.Nil(t, err)
+		assert.True(t, expected.Tip.Equals(merged.Tip))
+		// only the buckets which changed and the nodes above them are written, in one batch
+		assert.Equal(t, 0, store.adds)
+		assert.Equal(t, 1, store.addManys)
+		assert.Less(t, store.nodes, 6)
+	})
+}
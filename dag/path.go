@@ -0,0 +1,81 @@
+package dag
+
+import (
+	"fmt"
+	"strings"
+)
+
+// emptyKey is how PathString writes a key which is the empty string
+const emptyKey = `\0`
+
+// ParsePath splits a "/" separated path string into its keys. A "/" or "\" which is part
+// of a key is escaped with a "\" and an empty key is written as "\0" (see PathString), any
+// other escape is an error. A single leading "/" is allowed, "" and "/" are the empty path
+// and empty segments (like in "a//b" or "a/") are an error.
+func ParsePath(path string) ([]string, error) {
+	trimmed := strings.TrimPrefix(path, "/")
+	if trimmed == "" {
+		return []string{}, nil
+	}
+
+	var keys []string
+	for _, segment := range splitUnescaped(trimmed) {
+		if segment == "" {
+			return nil, fmt.Errorf("path %q contains an empty segment", path)
+		}
+		if segment == emptyKey {
+			keys = append(keys, "")
+			continue
+		}
+
+		var key strings.Builder
+		for i := 0; i < len(segment); i++ {
+			c := segment[i]
+			if c == '\\' {
+				if i+1 >= len(segment) {
+					return nil, fmt.Errorf("path %q ends with an unfinished escape", path)
+				}
+				i++
+				if segment[i] != '/' && segment[i] != '\\' {
+					return nil, fmt.Errorf("path %q contains an invalid escape \\%c", path, segment[i])
+				}
+				c = segment[i]
+			}
+			key.WriteByte(c)
+		}
+		keys = append(keys, key.String())
+	}
+	return keys, nil
+}
+
+// splitUnescaped splits s at every "/" which isn't escaped, leaving the escapes in place
+func splitUnescaped(s string) []string {
+	var segments []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '/':
+			segments = append(segments, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(segments, s[start:])
+}
+
+// PathString is the inverse of ParsePath, it joins the keys of path with "/" escaping any
+// "/" or "\" inside of them and writing empty keys as "\0"
+func PathString(path []string) string {
+	escaped := make([]string, len(path))
+	for i, key := range path {
+		if key == "" {
+			escaped[i] = emptyKey
+			continue
+		}
+		escaped[i] = pathEscaper.Replace(key)
+	}
+	return strings.Join(escaped, "/")
+}
+
+var pathEscaper = strings.NewReplacer(`\`, `\\`, `/`, `\/`)
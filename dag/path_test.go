@@ -0,0 +1,61 @@
+package dag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePath(t *testing.T) {
+	for _, path := range [][]string{
+		{},
+		{"a"},
+		{"down", "in", "the", "thing"},
+		{"a/b", "c"},
+		{"/", "//"},
+		{`back\slash`, `\`, `\\`},
+		{`trailing\`, `\/`},
+		{"did:tupelo:abc", "tree", "with space", "ünïcödé"},
+		{"*", "**", "[x]", "{y}"},
+		{"a", "", "b"},
+		{""},
+		{"", ""},
+		{`\0`, "0"},
+	} {
+		str := PathString(path)
+		parsed, err := ParsePath(str)
+		require.Nil(t, err, str)
+		assert.Equal(t, path, parsed, str)
+		assert.Equal(t, str, PathString(parsed))
+	}
+
+	for str, expected := range map[string][]string{
+		"":           {},
+		"/":          {},
+		"/a/b":       {"a", "b"},
+		`a\/b/c`:     {"a/b", "c"},
+		`a\\/b`:      {`a\`, "b"},
+		`\/\/`:       {"//"},
+		"did:tupelo": {"did:tupelo"},
+		`a/\0/b`:     {"a", "", "b"},
+		`\\0`:        {`\0`},
+	} {
+		parsed, err := ParsePath(str)
+		require.Nil(t, err, str)
+		assert.Equal(t, expected, parsed, str)
+	}
+
+	for _, str := range []string{
+		"a//b",
+		"a/",
+		"//a",
+		`a\`,
+		`a\b`,
+		`a\0`,
+		`\0a`,
+	} {
+		_, err := ParsePath(str)
+		assert.NotNil(t, err, str)
+	}
+}
@@ -0,0 +1,629 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Query is a parsed path query, see ParseQuery
+type Query struct {
+	segments   []*querySegment
+	projection [][]string
+}
+
+type querySegment struct {
+	// wildcard is "*" for any single key or "**" for any number of keys (including none),
+	// otherwise the segment matches key
+	wildcard   string
+	key        string
+	predicates []*queryPredicate
+}
+
+// queryPredicate compares the value at path (relative to the matched value, empty for
+// the value itself) with value. An empty op only checks that there is a value at path.
+type queryPredicate struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// QueryResult is a single match of a query
+type QueryResult struct {
+	Path  []string
+	Value interface{}
+}
+
+// GraftFunc lets a query carry on into another dag. It is given every value the query
+// passes through and returns the dag (and the path in it) the value stands for, with ok
+// false for values which aren't grafts.
+type GraftFunc func(ctx context.Context, val interface{}) (d *Dag, path []string, ok bool, err error)
+
+// ParseQuery parses a query made of "/" separated path segments, where each segment is
+// either a key, "*" matching every key of a map (or index of a list) or "**" matching
+// any number of levels, including none. Every segment can be followed by predicates
+// which the values it matches must pass:
+//
+//	[balance > 0]     the value at balance (a path relative to the match) compared to a literal
+//	[. = "active"]    the matched value itself
+//	[monetaryPolicy]  there is a value at monetaryPolicy
+//
+// The operators are =, !=, <, <=, > and >= and the literals are numbers, "quoted strings",
+// true, false and null. Numbers compare numerically, strings lexically, and values of
+// different types never match (except with !=). The query can end with a projection like
+// {balance, minted} to return just those paths of every match.
+//
+//	tree/_tupelo/tokens/*[balance > 0]{balance}
+//
+// Keys are escaped like in ParsePath, with "\0" for an empty key, but any other character
+// can be escaped with a "\" too (e.g. "\*" for a key which is really "*" or "\[" for a "["
+// inside of a key), so every path written by PathString can be used in a query.
+func ParseQuery(query string) (*Query, error) {
+	p := &queryParser{input: query}
+	q, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing query %q: %v", query, err)
+	}
+	return q, nil
+}
+
+// Query runs query (see ParseQuery) against the dag and returns every match, links are
+// followed as they are reached
+func (d *Dag) Query(ctx context.Context, query string) ([]*QueryResult, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(ctx, d, nil)
+}
+
+// Run returns the matches of the query in d. When graft is not nil every value the query
+// reaches is given to it, so the query can continue into other dags. Matches are returned
+// in the order they are found, keys of maps are visited in sorted order.
+func (q *Query) Run(ctx context.Context, d *Dag, graft GraftFunc) ([]*QueryResult, error) {
+	e := &queryEngine{
+		graft: graft,
+		seen:  make(map[string]struct{}),
+	}
+	err := e.match(ctx, q.segments, []string{}, &queryValue{dag: d, val: d.Tip}, func(path []string, v *queryValue) error {
+		key := PathString(path)
+		if _, ok := e.seen[key]; ok {
+			return nil
+		}
+		e.seen[key] = struct{}{}
+
+		result := &QueryResult{Path: path}
+		if len(q.projection) == 0 {
+			resolved, err := e.resolve(ctx, v)
+			if err != nil {
+				return err
+			}
+			result.Value = resolved.val
+		} else {
+			projected := make(map[string]interface{}, len(q.projection))
+			for _, p := range q.projection {
+				val, ok, err := e.lookup(ctx, v, p)
+				if err != nil {
+					return err
+				}
+				if ok {
+					projected[PathString(p)] = val.val
+				}
+			}
+			result.Value = projected
+		}
+		e.results = append(e.results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.results, nil
+}
+
+type queryEngine struct {
+	graft   GraftFunc
+	seen    map[string]struct{}
+	results []*QueryResult
+}
+
+// queryValue is a value and the dag it came from, grafts holds the grafts taken to get
+// to it so loops can be detected
+type queryValue struct {
+	dag    *Dag
+	val    interface{}
+	grafts []string
+}
+
+func (e *queryEngine) match(ctx context.Context, segments []*querySegment, path []string, v *queryValue, emit func([]string, *queryValue) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if len(segments) == 0 {
+		return emit(path, v)
+	}
+	seg := segments[0]
+
+	switch seg.wildcard {
+	case "**":
+		ok, err := e.matches(ctx, seg, v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := e.match(ctx, segments[1:], path, v, emit); err != nil {
+				return err
+			}
+		}
+		return e.eachChild(ctx, v, path, func(childPath []string, child *queryValue) error {
+			return e.match(ctx, segments, childPath, child, emit)
+		})
+	case "*":
+		return e.eachChild(ctx, v, path, func(childPath []string, child *queryValue) error {
+			ok, err := e.matches(ctx, seg, child)
+			if err != nil || !ok {
+				return err
+			}
+			return e.match(ctx, segments[1:], childPath, child, emit)
+		})
+	default:
+		child, ok, err := e.lookup(ctx, v, []string{seg.key})
+		if err != nil || !ok {
+			return err
+		}
+		ok, err = e.matches(ctx, seg, child)
+		if err != nil || !ok {
+			return err
+		}
+		return e.match(ctx, segments[1:], appendQueryPath(path, seg.key), child, emit)
+	}
+}
+
+// resolve follows links and grafts until it gets to a plain value
+func (e *queryEngine) resolve(ctx context.Context, v *queryValue) (*queryValue, error) {
+	for {
+		if id, ok := v.val.(cid.Cid); ok {
+			n, err := v.dag.Get(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+			}
+			if n == nil {
+				return v, nil
+			}
+			val, err := v.dag.nodeValue(ctx, n)
+			if err != nil {
+				return nil, err
+			}
+			v = &queryValue{dag: v.dag, val: val, grafts: v.grafts}
+			continue
+		}
+
+		if e.graft == nil || v.val == nil {
+			return v, nil
+		}
+		d, path, ok, err := e.graft(ctx, v.val)
+		if err != nil {
+			return nil, fmt.Errorf("error grafting %v: %v", v.val, err)
+		}
+		if !ok {
+			return v, nil
+		}
+		key := fmt.Sprint(v.val)
+		for _, seen := range v.grafts {
+			if seen == key {
+				return nil, fmt.Errorf("loop detected; %s was already visited in this query", key)
+			}
+		}
+		grafted, ok, err := e.lookup(ctx, &queryValue{dag: d, val: d.Tip, grafts: append(append([]string{}, v.grafts...), key)}, path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return &queryValue{dag: d}, nil
+		}
+		return grafted, nil
+	}
+}
+
+// lookup returns the value at path below v
+func (e *queryEngine) lookup(ctx context.Context, v *queryValue, path []string) (*queryValue, bool, error) {
+	for _, key := range path {
+		resolved, err := e.resolve(ctx, v)
+		if err != nil {
+			return nil, false, err
+		}
+		var child interface{}
+		switch val := resolved.val.(type) {
+		case map[string]interface{}:
+			child = val[key]
+		case []interface{}:
+			idx, err := listIndex(key, len(val))
+			if err != nil {
+				return nil, false, nil
+			}
+			child = val[idx]
+		}
+		if child == nil {
+			return nil, false, nil
+		}
+		v = &queryValue{dag: resolved.dag, val: child, grafts: resolved.grafts}
+	}
+	resolved, err := e.resolve(ctx, v)
+	if err != nil {
+		return nil, false, err
+	}
+	return resolved, resolved.val != nil, nil
+}
+
+func (e *queryEngine) eachChild(ctx context.Context, v *queryValue, path []string, fn func([]string, *queryValue) error) error {
+	resolved, err := e.resolve(ctx, v)
+	if err != nil {
+		return err
+	}
+	switch val := resolved.val.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := &queryValue{dag: resolved.dag, val: val[k], grafts: resolved.grafts}
+			if err := fn(appendQueryPath(path, k), child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			child := &queryValue{dag: resolved.dag, val: item, grafts: resolved.grafts}
+			if err := fn(appendQueryPath(path, strconv.Itoa(i)), child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *queryEngine) matches(ctx context.Context, seg *querySegment, v *queryValue) (bool, error) {
+	for _, p := range seg.predicates {
+		val, ok, err := e.lookup(ctx, v, p.path)
+		if err != nil {
+			return false, err
+		}
+		if p.op == "" {
+			if !ok {
+				return false, nil
+			}
+			continue
+		}
+		var actual interface{}
+		if ok {
+			actual = val.val
+		}
+		if !p.compare(actual) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (p *queryPredicate) compare(actual interface{}) bool {
+	var cmp int
+	switch expected := p.value.(type) {
+	case nil:
+		if actual != nil {
+			return p.op == "!="
+		}
+		cmp = 0
+	case string:
+		s, ok := actual.(string)
+		if !ok {
+			return p.op == "!="
+		}
+		cmp = strings.Compare(s, expected)
+	case bool:
+		b, ok := actual.(bool)
+		if !ok || (p.op != "=" && p.op != "!=") {
+			return p.op == "!=" && !ok
+		}
+		if b != expected {
+			cmp = 1
+		}
+	case *big.Float:
+		n, ok := toBigFloat(actual)
+		if !ok {
+			return p.op == "!="
+		}
+		cmp = n.Cmp(expected)
+	}
+
+	switch p.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return false
+	}
+}
+
+func toBigFloat(val interface{}) (*big.Float, bool) {
+	switch val := val.(type) {
+	case int:
+		return new(big.Float).SetInt64(int64(val)), true
+	case int8:
+		return new(big.Float).SetInt64(int64(val)), true
+	case int16:
+		return new(big.Float).SetInt64(int64(val)), true
+	case int32:
+		return new(big.Float).SetInt64(int64(val)), true
+	case int64:
+		return new(big.Float).SetInt64(val), true
+	case uint:
+		return new(big.Float).SetUint64(uint64(val)), true
+	case uint8:
+		return new(big.Float).SetUint64(uint64(val)), true
+	case uint16:
+		return new(big.Float).SetUint64(uint64(val)), true
+	case uint32:
+		return new(big.Float).SetUint64(uint64(val)), true
+	case uint64:
+		return new(big.Float).SetUint64(val), true
+	case float32:
+		return new(big.Float).SetFloat64(float64(val)), true
+	case float64:
+		return new(big.Float).SetFloat64(val), true
+	default:
+		return nil, false
+	}
+}
+
+func appendQueryPath(path []string, key string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), key)
+}
+
+type queryParser struct {
+	input string
+	pos   int
+}
+
+func (p *queryParser) parse() (*Query, error) {
+	q := &Query{}
+	if strings.HasPrefix(p.input, "/") {
+		p.pos++
+	}
+	for {
+		start := p.pos
+		key, escaped, err := p.key("/[{")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" && !escaped {
+			return nil, fmt.Errorf("empty path segment at %d", start)
+		}
+		seg := &querySegment{key: key}
+		if !escaped && (key == "*" || key == "**") {
+			seg.wildcard = key
+		}
+		for p.peek() == '[' {
+			pred, err := p.predicate()
+			if err != nil {
+				return nil, err
+			}
+			seg.predicates = append(seg.predicates, pred)
+		}
+		q.segments = append(q.segments, seg)
+
+		switch p.peek() {
+		case 0:
+			return q, nil
+		case '/':
+			p.pos++
+		case '{':
+			projection, err := p.projection()
+			if err != nil {
+				return nil, err
+			}
+			q.projection = projection
+			if p.pos < len(p.input) {
+				return nil, fmt.Errorf("unexpected %q after projection at %d", p.input[p.pos:], p.pos)
+			}
+			return q, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", p.peek(), p.pos)
+		}
+	}
+}
+
+func (p *queryParser) predicate() (*queryPredicate, error) {
+	start := p.pos
+	p.pos++ // [
+	p.skipSpaces()
+
+	pred := &queryPredicate{}
+	if strings.HasPrefix(p.input[p.pos:], ".") && (p.pos+1 == len(p.input) || strings.IndexByte(" =!<>]", p.input[p.pos+1]) >= 0) {
+		p.pos++
+	} else {
+		path, err := p.keyPath(" =!<>]")
+		if err != nil {
+			return nil, fmt.Errorf("invalid path in predicate at %d: %v", start, err)
+		}
+		pred.path = path
+	}
+
+	p.skipSpaces()
+	if p.peek() == ']' {
+		p.pos++
+		return pred, nil
+	}
+
+	for _, op := range []string{"!=", "<=", ">=", "==", "=", "<", ">"} {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			pred.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if pred.op == "" {
+		return nil, fmt.Errorf("expected an operator at %d", p.pos)
+	}
+	if pred.op == "==" {
+		pred.op = "="
+	}
+
+	p.skipSpaces()
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	pred.value = value
+
+	p.skipSpaces()
+	if p.peek() != ']' {
+		return nil, fmt.Errorf("expected ] at %d", p.pos)
+	}
+	p.pos++
+	return pred, nil
+}
+
+func (p *queryParser) literal() (interface{}, error) {
+	start := p.pos
+	if p.peek() == '"' {
+		p.pos++
+		for p.pos < len(p.input) && p.input[p.pos] != '"' {
+			if p.input[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			return nil, fmt.Errorf("unterminated string at %d", start)
+		}
+		p.pos++
+		s, err := strconv.Unquote(p.input[start:p.pos])
+		if err != nil {
+			return nil, fmt.Errorf("invalid string at %d: %v", start, err)
+		}
+		return s, nil
+	}
+
+	raw := p.readUntil(" ]")
+	switch raw {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	n, ok := new(big.Float).SetString(raw)
+	if !ok {
+		return nil, fmt.Errorf("invalid literal %q at %d", raw, start)
+	}
+	return n, nil
+}
+
+func (p *queryParser) projection() ([][]string, error) {
+	start := p.pos
+	p.pos++ // {
+	var projection [][]string
+	for {
+		p.skipSpaces()
+		path, err := p.keyPath(" ,}")
+		if err != nil {
+			return nil, fmt.Errorf("invalid field in projection at %d: %v", start, err)
+		}
+		projection = append(projection, path)
+		p.skipSpaces()
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return projection, nil
+		default:
+			return nil, fmt.Errorf("unterminated projection at %d", start)
+		}
+	}
+}
+
+// keyPath reads "/" separated keys up to one of the stop characters
+func (p *queryParser) keyPath(stop string) ([]string, error) {
+	var path []string
+	for {
+		key, escaped, err := p.key("/" + stop)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" && !escaped {
+			return nil, fmt.Errorf("empty key at %d", p.pos)
+		}
+		path = append(path, key)
+		if p.peek() != '/' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+// key reads a single key up to one of the stop characters, a "\" makes the character
+// after it part of the key whatever it is, except for a key which is just "\0" (see
+// emptyKey) which is the empty key. escaped is true if there was any escape.
+func (p *queryParser) key(stop string) (key string, escaped bool, err error) {
+	if rest := p.input[p.pos:]; strings.HasPrefix(rest, emptyKey) &&
+		(len(rest) == len(emptyKey) || strings.IndexByte(stop, rest[len(emptyKey)]) >= 0) {
+		p.pos += len(emptyKey)
+		return "", true, nil
+	}
+	var b strings.Builder
+	for p.pos < len(p.input) && strings.IndexByte(stop, p.input[p.pos]) < 0 {
+		if p.input[p.pos] == '\\' {
+			if p.pos+1 >= len(p.input) {
+				return "", false, fmt.Errorf("unfinished escape at %d", p.pos)
+			}
+			escaped = true
+			p.pos++
+		}
+		b.WriteByte(p.input[p.pos])
+		p.pos++
+	}
+	return b.String(), escaped, nil
+}
+
+func (p *queryParser) readUntil(stop string) string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(stop, rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *queryParser) skipSpaces() {
+	for p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
@@ -0,0 +1,122 @@
+package dag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tree := newDeepAndWideDag(t, ctx)
+	tokens := map[string]interface{}{
+		"gold":   map[string]interface{}{"balance": 10, "monetaryPolicy": map[string]interface{}{"maximum": 100}},
+		"silver": map[string]interface{}{"balance": 0},
+		"bronze": map[string]interface{}{"balance": 3, "name": "bronze"},
+	}
+	for name, token := range tokens {
+		var err error
+		tree, err = tree.SetAsLink(ctx, []string{"tree", "_tupelo", "tokens", name}, token)
+		require.Nil(t, err)
+	}
+	tree, err := tree.Set(ctx, []string{"tree", "list"}, []interface{}{1, "two", 3})
+	require.Nil(t, err)
+	tree, err = tree.ShardMap(ctx, []string{"tree", "sharded"})
+	require.Nil(t, err)
+	tree, err = tree.Set(ctx, []string{"tree", "sharded", "a", "balance"}, 5)
+	require.Nil(t, err)
+	tree, err = tree.Set(ctx, []string{"tree", "odd/keys", "*", "a/b"}, 1)
+	require.Nil(t, err)
+	tree, err = tree.Set(ctx, []string{"tree", "odd/keys", "[x]", "a/b"}, 2)
+	require.Nil(t, err)
+	tree, err = tree.Set(ctx, []string{"tree", "", "", "0"}, 3)
+	require.Nil(t, err)
+
+	paths := func(results []*QueryResult) []string {
+		out := make([]string, len(results))
+		for i, r := range results {
+			out[i] = PathString(r.Path)
+		}
+		return out
+	}
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"child1/child1", []string{"child1/child1"}},
+		{"/child1/deepChild1/deepChild", []string{"child1/deepChild1/deepChild"}},
+		{"missing/*", []string{}},
+		{"*/deepChild1", []string{"child1/deepChild1"}},
+		{"*/*/deepChild", []string{"child1/deepChild1/deepChild", "child2/deepChild2/deepChild"}},
+		{"tree/_tupelo/tokens/*", []string{"tree/_tupelo/tokens/bronze", "tree/_tupelo/tokens/gold", "tree/_tupelo/tokens/silver"}},
+		{"tree/_tupelo/tokens/*[balance > 0]", []string{"tree/_tupelo/tokens/bronze", "tree/_tupelo/tokens/gold"}},
+		{"tree/_tupelo/tokens/*[balance > 0][name]", []string{"tree/_tupelo/tokens/bronze"}},
+		{"tree/_tupelo/tokens/*[monetaryPolicy/maximum >= 100]", []string{"tree/_tupelo/tokens/gold"}},
+		{"tree/_tupelo/tokens/*[name = \"bronze\"]", []string{"tree/_tupelo/tokens/bronze"}},
+		{"tree/_tupelo/tokens/*[name != \"bronze\"]", []string{"tree/_tupelo/tokens/gold", "tree/_tupelo/tokens/silver"}},
+		{"tree/_tupelo/tokens/*[name = null]", []string{"tree/_tupelo/tokens/gold", "tree/_tupelo/tokens/silver"}},
+		{"tree/list/*[. < 3]", []string{"tree/list/0"}},
+		{"tree/list/1[. = \"two\"]", []string{"tree/list/1"}},
+		{"**/balance[. >= 3]", []string{"tree/_tupelo/tokens/bronze/balance", "tree/_tupelo/tokens/gold/balance", "tree/sharded/a/balance"}},
+		{"**/deepChild", []string{"child1/deepChild1/deepChild", "child2/deepChild2/deepChild"}},
+		{"tree/**/**/maximum", []string{"tree/_tupelo/tokens/gold/monetaryPolicy/maximum"}},
+		{"tree/sharded/*", []string{"tree/sharded/a"}},
+		{`tree/odd\/keys/\*[a\/b = 1]`, []string{`tree/odd\/keys/*`}},
+		{`tree/odd\/keys/*{a\/b}`, []string{`tree/odd\/keys/*`, `tree/odd\/keys/[x]`}},
+		{`tree/odd\/keys/\[x\]`, []string{`tree/odd\/keys/[x]`}},
+		{PathString([]string{"tree", "", ""}), []string{`tree/\0/\0`}},
+		{`tree/\0/*[\0 = 3]`, []string{}},
+		{`tree/*/\0[0 = 3]`, []string{`tree/\0/\0`}},
+		{`tree/\0/\0/\0`, []string{}},
+	} {
+		results, err := tree.Query(ctx, test.query)
+		require.Nil(t, err, test.query)
+		assert.Equal(t, test.expected, paths(results), test.query)
+	}
+
+	t.Run("values", func(t *testing.T) {
+		results, err := tree.Query(ctx, "tree/_tupelo/tokens/gold/monetaryPolicy")
+		require.Nil(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, map[string]interface{}{"maximum": 100}, results[0].Value)
+	})
+
+	t.Run("empty keys", func(t *testing.T) {
+		results, err := tree.Query(ctx, `tree/\0/\0{0}`)
+		require.Nil(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, []string{"tree", "", ""}, results[0].Path)
+		assert.Equal(t, map[string]interface{}{"0": 3}, results[0].Value)
+	})
+
+	t.Run("projection", func(t *testing.T) {
+		results, err := tree.Query(ctx, "tree/_tupelo/tokens/*[balance > 0]{balance, monetaryPolicy/maximum}")
+		require.Nil(t, err)
+		require.Len(t, results, 2)
+		assert.Equal(t, map[string]interface{}{"balance": 3}, results[0].Value)
+		assert.Equal(t, map[string]interface{}{"balance": 10, "monetaryPolicy/maximum": 100}, results[1].Value)
+	})
+
+	t.Run("invalid queries", func(t *testing.T) {
+		for _, query := range []string{
+			"",
+			"tree//tokens",
+			"tree/*[balance >]",
+			"tree/*[balance ~ 1]",
+			"tree/*[ = 1]",
+			"tree/*[name = \"unterminated]",
+			"tree/*[balance > 0",
+			"tree/*{balance",
+			"tree/*{balance,}",
+			"tree/*{balance}/more",
+		} {
+			_, err := ParseQuery(query)
+			assert.NotNil(t, err, query)
+		}
+	})
+}
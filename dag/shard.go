@@ -0,0 +1,593 @@
+package dag
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+func init() {
+	cbornode.RegisterCborType(shardNode{})
+	cbornode.RegisterCborType(shardPointer{})
+	cbornode.RegisterCborType(shardEntry{})
+}
+
+const (
+	// shardMarker is the key which marks a node as part of a sharded map, it is reserved
+	// and can't be used as a key anywhere in the data written to a dag (see checkReserved)
+	shardMarker = "__hamt"
+	// shardBitWidth is the number of bits of the key hash used at each level, giving
+	// each node up to 32 pointers
+	shardBitWidth = 5
+	// shardBucketSize is the number of entries a pointer holds before they get pushed
+	// down into their own node
+	shardBucketSize = 3
+)
+
+// shardNode is a node of a sharded map (a HAMT). The keys are hashed with sha256 and every
+// level of the tree uses the next shardBitWidth bits of the hash to pick a pointer. Buckets
+// are kept sorted and a child node only exists when it holds more than shardBucketSize
+// entries, so the same entries always give the same nodes no matter the order of changes.
+type shardNode struct {
+	Bitfield uint32          `refmt:"__hamt" json:"__hamt" cbor:"__hamt"`
+	Pointers []*shardPointer `refmt:"pointers" json:"pointers" cbor:"pointers"`
+
+	// id is the CID the node was loaded from (cid.Undef for new nodes) and dirty is set
+	// once its own pointers change, a clean node with clean children is never rewritten
+	id    cid.Cid
+	dirty bool
+}
+
+// shardPointer is either a link to a child node or a bucket of entries
+type shardPointer struct {
+	Link    *cid.Cid      `refmt:"link,omitempty" json:"link,omitempty" cbor:"link,omitempty"`
+	Entries []*shardEntry `refmt:"entries,omitempty" json:"entries,omitempty" cbor:"entries,omitempty"`
+
+	// child is the loaded (and maybe changed) node Link points to
+	child *shardNode
+}
+
+type shardEntry struct {
+	Key   string      `refmt:"key" json:"key" cbor:"key"`
+	Value interface{} `refmt:"value" json:"value" cbor:"value"`
+}
+
+func (p *shardPointer) isBucket() bool {
+	return p.Link == nil && p.child == nil
+}
+
+// shard is a sharded map being read or changed in memory, nodes are loaded from the
+// dag as they are needed and nothing is stored until write
+type shard struct {
+	dag  *Dag
+	root *shardNode
+}
+
+// ShardMap turns the map at path into a sharded map, or creates an empty one when nothing
+// is at path yet. Set, SetAsLink, Delete and Resolve work on sharded maps like on any
+// other map, but an update only rewrites the few nodes on the way to its key instead of
+// one node holding every key, which keeps very large maps cheap to change. Resolving the
+// sharded map itself returns all of its entries as a map, which loads every node in it.
+func (d *Dag) ShardMap(ctx context.Context, path []string) (*Dag, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("the root of a dag can not be sharded")
+	}
+
+	existing, remaining, err := d.resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %v: %v", path, err)
+	}
+
+	s := &shard{dag: d, root: &shardNode{}}
+	if len(remaining) == 0 {
+		switch existing := existing.(type) {
+		case *shard:
+			return d, nil
+		case map[string]interface{}:
+			for k, v := range existing {
+				if err := s.set(ctx, k, v); err != nil {
+					return nil, err
+				}
+			}
+		case nil:
+		default:
+			return nil, fmt.Errorf("value at path %v is not a map", path)
+		}
+	}
+
+	return d.withBatch(ctx, func(batch *format.Batch) (*Dag, error) {
+		id, _, err := s.write(ctx, batch, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(remaining) == 0 {
+			return d.replace(ctx, batch, path, id)
+		}
+		return d.setWithBatch(ctx, batch, path, id, false)
+	})
+}
+
+// loadShard returns the sharded map with its root at n
+func (d *Dag) loadShard(n format.Node) (*shard, error) {
+	root, err := decodeShardNode(n)
+	if err != nil {
+		return nil, err
+	}
+	return &shard{dag: d, root: root}, nil
+}
+
+// decodeShardNode decodes a fresh copy of n so changes never leak into cached nodes
+func decodeShardNode(n format.Node) (*shardNode, error) {
+	node := &shardNode{}
+	err := cbornode.DecodeInto(n.RawData(), node)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding shard (%s): %v", n.Cid().String(), err)
+	}
+	if len(node.Pointers) != bits.OnesCount32(node.Bitfield) {
+		return nil, fmt.Errorf("invalid shard (%s): pointers don't match the bitfield", n.Cid().String())
+	}
+	node.id = n.Cid()
+	return node, nil
+}
+
+// isShardLink returns true when val is a link to a sharded map
+func (d *Dag) isShardLink(ctx context.Context, val interface{}) (bool, error) {
+	id, ok := val.(cid.Cid)
+	if !ok {
+		return false, nil
+	}
+	n, err := d.Get(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+	}
+	return n != nil && isShardNode(n), nil
+}
+
+// nodeValue returns the decoded object of n, sharded maps are returned with all their entries
+func (d *Dag) nodeValue(ctx context.Context, n format.Node) (interface{}, error) {
+	if isShardNode(n) {
+		s, err := d.loadShard(n)
+		if err != nil {
+			return nil, err
+		}
+		return s.toMap(ctx)
+	}
+	obj, _, err := n.Resolve(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving node (%s): %v", n.Cid().String(), err)
+	}
+	return obj, nil
+}
+
+// checkReserved returns an error when shardMarker is one of the keys of path or of any
+// map inside val, a node holding such a map would be taken for part of a sharded map
+func checkReserved(path []string, val interface{}) error {
+	for _, k := range path {
+		if k == shardMarker {
+			return fmt.Errorf("%s is a reserved key", shardMarker)
+		}
+	}
+	return checkReservedValue(reflect.ValueOf(val))
+}
+
+func checkReservedValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return checkReservedValue(v.Elem())
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if iter.Key().String() == shardMarker {
+				return fmt.Errorf("%s is a reserved key", shardMarker)
+			}
+			if err := checkReservedValue(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := checkReservedValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue // unexported
+			}
+			if err := checkReservedValue(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkNode returns an error when shardMarker is in n anywhere but at the top of a valid
+// node of a sharded map, nodes which aren't cbor aren't checked
+func checkNode(n format.Node) error {
+	if _, ok := n.(*cbornode.Node); !ok {
+		return nil
+	}
+	if !isShardNode(n) {
+		obj, _, err := n.Resolve(nil)
+		if err != nil {
+			return fmt.Errorf("error resolving node (%s): %v", n.Cid().String(), err)
+		}
+		if err := checkReserved(nil, obj); err != nil {
+			return fmt.Errorf("invalid node (%s): %v", n.Cid().String(), err)
+		}
+		return nil
+	}
+
+	node, err := decodeShardNode(n)
+	if err != nil {
+		return err
+	}
+	for _, p := range node.Pointers {
+		if p == nil || (p.Link == nil) == (len(p.Entries) == 0) {
+			return fmt.Errorf("invalid shard (%s): pointers must hold either a link or entries", n.Cid().String())
+		}
+		for _, e := range p.Entries {
+			if err := checkReserved([]string{e.Key}, e.Value); err != nil {
+				return fmt.Errorf("invalid shard (%s): %v", n.Cid().String(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func isShardNode(n format.Node) bool {
+	_, _, err := n.Resolve([]string{shardMarker})
+	return err == nil
+}
+
+func shardHash(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// shardIndex returns the pointer index for the hash at depth
+func shardIndex(hash []byte, depth int) (int, error) {
+	start := depth * shardBitWidth
+	if start+shardBitWidth > len(hash)*8 {
+		return 0, fmt.Errorf("sharded map is too deep")
+	}
+	idx := 0
+	for i := start; i < start+shardBitWidth; i++ {
+		idx = idx<<1 | int(hash[i/8]>>uint(7-i%8)&1)
+	}
+	return idx, nil
+}
+
+func (s *shard) get(ctx context.Context, key string) (*shardEntry, error) {
+	return s.find(ctx, s.root, shardHash(key), 0, key)
+}
+
+func (s *shard) set(ctx context.Context, key string, val interface{}) error {
+	return s.insert(ctx, s.root, shardHash(key), 0, &shardEntry{Key: key, Value: val})
+}
+
+// delete removes key and returns false if it wasn't there
+func (s *shard) delete(ctx context.Context, key string) (bool, error) {
+	return s.remove(ctx, s.root, shardHash(key), 0, key)
+}
+
+// toMap returns every entry of the sharded map
+func (s *shard) toMap(ctx context.Context) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	err := s.forEach(ctx, s.root, func(e *shardEntry) {
+		obj[e.Key] = e.Value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *shard) child(ctx context.Context, p *shardPointer) (*shardNode, error) {
+	if p.child != nil {
+		return p.child, nil
+	}
+	n, err := s.dag.Get(ctx, *p.Link)
+	if err != nil {
+		return nil, fmt.Errorf("error getting shard (%s): %v", p.Link.String(), err)
+	}
+	if n == nil {
+		return nil, fmt.Errorf("shard %s not found", p.Link.String())
+	}
+	child, err := decodeShardNode(n)
+	if err != nil {
+		return nil, err
+	}
+	p.child = child
+	return child, nil
+}
+
+func (s *shard) find(ctx context.Context, n *shardNode, hash []byte, depth int, key string) (*shardEntry, error) {
+	idx, err := shardIndex(hash, depth)
+	if err != nil {
+		return nil, err
+	}
+	bit := uint32(1) << uint(idx)
+	if n.Bitfield&bit == 0 {
+		return nil, nil
+	}
+	p := n.Pointers[bits.OnesCount32(n.Bitfield&(bit-1))]
+	if !p.isBucket() {
+		child, err := s.child(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		return s.find(ctx, child, hash, depth+1, key)
+	}
+	for _, e := range p.Entries {
+		if e.Key == key {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *shard) insert(ctx context.Context, n *shardNode, hash []byte, depth int, entry *shardEntry) error {
+	idx, err := shardIndex(hash, depth)
+	if err != nil {
+		return err
+	}
+	bit := uint32(1) << uint(idx)
+	pos := bits.OnesCount32(n.Bitfield & (bit - 1))
+	if n.Bitfield&bit == 0 {
+		n.dirty = true
+		n.Bitfield |= bit
+		n.Pointers = append(n.Pointers, nil)
+		copy(n.Pointers[pos+1:], n.Pointers[pos:])
+		n.Pointers[pos] = &shardPointer{Entries: []*shardEntry{entry}}
+		return nil
+	}
+
+	p := n.Pointers[pos]
+	if !p.isBucket() {
+		child, err := s.child(ctx, p)
+		if err != nil {
+			return err
+		}
+		return s.insert(ctx, child, hash, depth+1, entry)
+	}
+
+	n.dirty = true
+	i := sort.Search(len(p.Entries), func(i int) bool { return p.Entries[i].Key >= entry.Key })
+	if i < len(p.Entries) && p.Entries[i].Key == entry.Key {
+		p.Entries[i] = entry
+		return nil
+	}
+	if len(p.Entries) < shardBucketSize {
+		p.Entries = append(p.Entries, nil)
+		copy(p.Entries[i+1:], p.Entries[i:])
+		p.Entries[i] = entry
+		return nil
+	}
+
+	// the bucket is full, push all of it down into a new node
+	child := &shardNode{}
+	for _, e := range append(p.Entries, entry) {
+		if err := s.insert(ctx, child, shardHash(e.Key), depth+1, e); err != nil {
+			return err
+		}
+	}
+	p.Entries = nil
+	p.child = child
+	return nil
+}
+
+func (s *shard) remove(ctx context.Context, n *shardNode, hash []byte, depth int, key string) (bool, error) {
+	idx, err := shardIndex(hash, depth)
+	if err != nil {
+		return false, err
+	}
+	bit := uint32(1) << uint(idx)
+	if n.Bitfield&bit == 0 {
+		return false, nil
+	}
+	pos := bits.OnesCount32(n.Bitfield & (bit - 1))
+	p := n.Pointers[pos]
+
+	if p.isBucket() {
+		for i, e := range p.Entries {
+			if e.Key == key {
+				n.dirty = true
+				p.Entries = append(p.Entries[:i], p.Entries[i+1:]...)
+				if len(p.Entries) == 0 {
+					n.removePointer(pos, bit)
+				}
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	child, err := s.child(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	found, err := s.remove(ctx, child, hash, depth+1, key)
+	if err != nil || !found {
+		return found, err
+	}
+	// a child which has shrunk to a bucket's worth of entries goes back into a bucket,
+	// so the shape only depends on the entries
+	if entries, ok := child.collapse(); ok {
+		n.dirty = true
+		p.Link = nil
+		p.child = nil
+		p.Entries = entries
+		if len(entries) == 0 {
+			n.removePointer(pos, bit)
+		}
+	}
+	return true, nil
+}
+
+func (n *shardNode) removePointer(pos int, bit uint32) {
+	n.Bitfield &^= bit
+	n.Pointers = append(n.Pointers[:pos], n.Pointers[pos+1:]...)
+}
+
+// collapse returns the (sorted) entries of n if they fit in a single bucket
+func (n *shardNode) collapse() ([]*shardEntry, bool) {
+	var entries []*shardEntry
+	for _, p := range n.Pointers {
+		if !p.isBucket() {
+			return nil, false
+		}
+		entries = append(entries, p.Entries...)
+		if len(entries) > shardBucketSize {
+			return nil, false
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, true
+}
+
+// findEntry looks key up in n alone, which is at depth in its sharded map (the root of the
+// map is at depth 0). It returns the entry when n holds it, the link to the node at depth+1
+// which would hold it, or neither when key isn't in the map.
+func (n *shardNode) findEntry(key string, depth int) (*shardEntry, *cid.Cid, error) {
+	idx, err := shardIndex(shardHash(key), depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := n.pointer(uint32(1) << uint(idx))
+	if p == nil {
+		return nil, nil, nil
+	}
+	if p.Link != nil {
+		return nil, p.Link, nil
+	}
+	for _, e := range p.Entries {
+		if e.Key == key {
+			return e, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// pointer returns the pointer for bit, or nil when the node has none
+func (n *shardNode) pointer(bit uint32) *shardPointer {
+	if n.Bitfield&bit == 0 {
+		return nil
+	}
+	return n.Pointers[bits.OnesCount32(n.Bitfield&(bit-1))]
+}
+
+// pointerEntries returns every entry under p (which may be nil)
+func (s *shard) pointerEntries(ctx context.Context, p *shardPointer) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	if p == nil {
+		return obj, nil
+	}
+	if p.isBucket() {
+		for _, e := range p.Entries {
+			obj[e.Key] = e.Value
+		}
+		return obj, nil
+	}
+	child, err := s.child(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	err = s.forEach(ctx, child, func(e *shardEntry) {
+		obj[e.Key] = e.Value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *shard) forEach(ctx context.Context, n *shardNode, fn func(e *shardEntry)) error {
+	for _, p := range n.Pointers {
+		if p.isBucket() {
+			for _, e := range p.Entries {
+				fn(e)
+			}
+			continue
+		}
+		child, err := s.child(ctx, p)
+		if err != nil {
+			return err
+		}
+		if err := s.forEach(ctx, child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write adds every changed node of the sharded map to batch and returns the CID of the
+// root and whether it changed, convert (if not nil) is applied to the values first and
+// reports whether it changed them. The shard itself is left as it is.
+func (s *shard) write(ctx context.Context, batch *format.Batch, convert func(interface{}) (interface{}, bool, error)) (cid.Cid, bool, error) {
+	return s.writeNode(ctx, batch, s.root, convert)
+}
+
+func (s *shard) writeNode(ctx context.Context, batch *format.Batch, n *shardNode, convert func(interface{}) (interface{}, bool, error)) (cid.Cid, bool, error) {
+	out := &shardNode{
+		Bitfield: n.Bitfield,
+		Pointers: make([]*shardPointer, len(n.Pointers)),
+	}
+	changed := n.dirty || !n.id.Defined()
+	for i, p := range n.Pointers {
+		switch {
+		case p.child != nil:
+			id, childChanged, err := s.writeNode(ctx, batch, p.child, convert)
+			if err != nil {
+				return cid.Undef, false, err
+			}
+			changed = changed || childChanged
+			out.Pointers[i] = &shardPointer{Link: &id}
+		case p.Link != nil:
+			out.Pointers[i] = &shardPointer{Link: p.Link}
+		default:
+			entries := make([]*shardEntry, len(p.Entries))
+			for j, e := range p.Entries {
+				val := e.Value
+				if convert != nil {
+					var valChanged bool
+					var err error
+					val, valChanged, err = convert(val)
+					if err != nil {
+						return cid.Undef, false, err
+					}
+					changed = changed || valChanged
+				}
+				entries[j] = &shardEntry{Key: e.Key, Value: val}
+			}
+			out.Pointers[i] = &shardPointer{Entries: entries}
+		}
+	}
+	if !changed {
+		return n.id, false, nil
+	}
+
+	node, err := s.dag.createNode(ctx, batch, out)
+	if err != nil {
+		return cid.Undef, false, fmt.Errorf("error creating shard: %v", err)
+	}
+	return node.Cid(), true, nil
+}
@@ -0,0 +1,268 @@
+package dag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/quorumcontrol/chaintree/safewrap"
+)
+
+func TestShardMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := newDeepAndWideDag(t, ctx)
+	base, err := base.ShardMap(ctx, []string{"child1", "balances"})
+	require.Nil(t, err)
+
+	count := 500
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	sharded := base
+	for i, k := range keys {
+		sharded, err = sharded.Set(ctx, []string{"child1", "balances", k}, i)
+		require.Nil(t, err)
+	}
+
+	for i, k := range keys {
+		val, remaining, err := sharded.Resolve(ctx, []string{"child1", "balances", k})
+		require.Nil(t, err)
+		assert.Len(t, remaining, 0)
+		assert.Equal(t, i, val)
+	}
+	val, remaining, err := sharded.Resolve(ctx, []string{"child1", "balances", "missing"})
+	require.Nil(t, err)
+	assert.Nil(t, val)
+	assert.Equal(t, []string{"missing"}, remaining)
+
+	all, _, err := sharded.Resolve(ctx, []string{"child1", "balances"})
+	require.Nil(t, err)
+	assert.Len(t, all, count)
+
+	// the rest of the tree is untouched
+	val, _, err = sharded.Resolve(ctx, []string{"child1", "deepChild1", "deepChild"})
+	require.Nil(t, err)
+	assert.Equal(t, true, val)
+
+	t.Run("the order of changes does not matter", func(t *testing.T) {
+		shuffled := base
+		for _, i := range rand.Perm(count) {
+			shuffled, err = shuffled.Set(ctx, []string{"child1", "balances", keys[i]}, i)
+			require.Nil(t, err)
+		}
+		assert.True(t, sharded.Tip.Equals(shuffled.Tip))
+
+		// deleting keys gives the same tip as never setting them
+		half := base
+		for i, k := range keys[:count/2] {
+			half, err = half.Set(ctx, []string{"child1", "balances", k}, i)
+			require.Nil(t, err)
+		}
+		deleted := sharded
+		for _, k := range keys[count/2:] {
+			deleted, err = deleted.Delete(ctx, []string{"child1", "balances", k})
+			require.Nil(t, err)
+		}
+		assert.True(t, half.Tip.Equals(deleted.Tip))
+
+		_, err = deleted.Delete(ctx, []string{"child1", "balances", keys[count-1]})
+		require.NotNil(t, err)
+	})
+
+	t.Run("updates only write a few nodes", func(t *testing.T) {
+		store := &countingStore{DagStore: sharded.Store}
+		counted := sharded.WithNewTip(sharded.Tip)
+		counted.Store = store
+
+		_, err := counted.Set(ctx, []string{"child1", "balances", "key1"}, "changed")
+		require.Nil(t, err)
+		// the shard nodes down to the key plus child1 and the root
+		assert.True(t, store.nodes < 6, "wrote %d nodes", store.nodes)
+	})
+
+	t.Run("paths below sharded keys", func(t *testing.T) {
+		nested, err := sharded.Set(ctx, []string{"child1", "balances", "new", "deeper", "key"}, "value")
+		require.Nil(t, err)
+		nested, err = nested.SetAsLink(ctx, []string{"child1", "balances", "linked"}, map[string]interface{}{"hi": "there"})
+		require.Nil(t, err)
+		nested, err = nested.Set(ctx, []string{"child1", "balances", "list"}, []interface{}{"a", "b"})
+		require.Nil(t, err)
+
+		for _, test := range []struct {
+			path     []string
+			expected interface{}
+		}{
+			{path: []string{"child1", "balances", "new", "deeper", "key"}, expected: "value"},
+			{path: []string{"child1", "balances", "linked", "hi"}, expected: "there"},
+			{path: []string{"child1", "balances", "list", "1"}, expected: "b"},
+		} {
+			val, remaining, err := nested.Resolve(ctx, test.path)
+			require.Nil(t, err)
+			assert.Len(t, remaining, 0)
+			assert.Equal(t, test.expected, val, "path %v", test.path)
+		}
+
+		nested, err = nested.Set(ctx, []string{"child1", "balances", "new", "deeper", "other"}, "value")
+		require.Nil(t, err)
+		deeper, _, err := nested.Resolve(ctx, []string{"child1", "balances", "new", "deeper"})
+		require.Nil(t, err)
+		assert.Len(t, deeper, 2)
+
+		_, err = nested.Set(ctx, []string{"child1", "balances", shardMarker}, "value")
+		require.NotNil(t, err)
+	})
+
+	t.Run("the shard marker is reserved in every written map", func(t *testing.T) {
+		plain := newDeepAndWideDag(t, ctx)
+		marked := map[string]interface{}{shardMarker: "x", "pointers": []interface{}{}}
+		nested := map[string]interface{}{"inner": []interface{}{marked}}
+
+		_, err := plain.SetAsLink(ctx, []string{"marked"}, marked)
+		assert.NotNil(t, err)
+		_, err = plain.SetAsLink(ctx, []string{"nested"}, nested)
+		assert.NotNil(t, err)
+		_, err = plain.SetAsLink(ctx, []string{"typed"}, map[string]map[string]int{"inner": {shardMarker: 1}})
+		assert.NotNil(t, err)
+		_, err = plain.Update(ctx, []string{"child1"}, marked)
+		assert.NotNil(t, err)
+
+		builder := plain.NewBuilder()
+		assert.NotNil(t, builder.SetAsLink(ctx, []string{"marked"}, marked))
+		assert.NotNil(t, builder.Set(ctx, []string{shardMarker}, 1))
+
+		_, err = ImportJSON(ctx, plain.Store, []byte(`{"a": {"__hamt": 1, "pointers": []}}`))
+		assert.NotNil(t, err)
+
+		_, err = plain.CreateNode(ctx, marked)
+		assert.NotNil(t, err)
+
+		// nodes which are already encoded are only accepted if they are valid shard nodes
+		sw := &safewrap.SafeWrap{}
+		forged := sw.WrapObject(map[string]interface{}{shardMarker: 0, "pointers": []interface{}{}, "other": true})
+		inner := sw.WrapObject(nested)
+		require.Nil(t, sw.Err)
+		assert.NotNil(t, plain.AddNodes(ctx, forged))
+		assert.NotNil(t, plain.AddNodes(ctx, inner))
+
+		var car bytes.Buffer
+		header, err := cbornode.DumpObject(&carHeader{Roots: []cid.Cid{forged.Cid()}, Version: 1})
+		require.Nil(t, err)
+		require.Nil(t, writeCarSection(&car, header))
+		require.Nil(t, writeCarBlock(&car, forged))
+		_, err = ImportCAR(ctx, plain.Store, &car)
+		assert.NotNil(t, err)
+
+		val, _, err := plain.Resolve(ctx, []string{"child1", "child1"})
+		require.Nil(t, err)
+		assert.Equal(t, true, val)
+	})
+
+	t.Run("sharding an existing map", func(t *testing.T) {
+		plain := newDeepAndWideDag(t, ctx)
+		for i, k := range keys[:20] {
+			plain, err = plain.Set(ctx, []string{"child1", "balances", k}, i)
+			require.Nil(t, err)
+		}
+		before, _, err := plain.Resolve(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+
+		converted, err := plain.ShardMap(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+		after, _, err := converted.Resolve(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+		assert.Equal(t, before, after)
+
+		again, err := converted.ShardMap(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+		assert.True(t, converted.Tip.Equals(again.Tip))
+
+		_, err = plain.ShardMap(ctx, []string{"child1", "child1"})
+		require.NotNil(t, err)
+	})
+
+	t.Run("in a builder", func(t *testing.T) {
+		expected, err := sharded.Set(ctx, []string{"child1", "balances", "key1"}, "changed")
+		require.Nil(t, err)
+		expected, err = expected.Set(ctx, []string{"child1", "balances", "new", "key"}, "value")
+		require.Nil(t, err)
+		expected, err = expected.Delete(ctx, []string{"child1", "balances", "key2"})
+		require.Nil(t, err)
+
+		builder := sharded.NewBuilder()
+		require.Nil(t, builder.Set(ctx, []string{"child1", "balances", "key1"}, "changed"))
+		require.Nil(t, builder.Set(ctx, []string{"child1", "balances", "new", "key"}, "value"))
+		require.Nil(t, builder.Delete(ctx, []string{"child1", "balances", "key2"}))
+		require.NotNil(t, builder.Delete(ctx, []string{"child1", "balances", "missing"}))
+		built, err := builder.Commit(ctx)
+		require.Nil(t, err)
+		assert.True(t, expected.Tip.Equals(built.Tip))
+	})
+
+	t.Run("nodes for paths below sharded keys", func(t *testing.T) {
+		linked, err := sharded.SetAsLink(ctx, []string{"child1", "balances", "linked"}, map[string]interface{}{"hi": "there"})
+		require.Nil(t, err)
+
+		nodes, err := linked.NodesForPath(ctx, []string{"child1", "balances", "linked"})
+		require.Nil(t, err)
+		// root, child1, the shard nodes down to the key and the linked node
+		require.True(t, len(nodes) > 4)
+		last := nodes[len(nodes)-1]
+		hi, _, err := last.Resolve([]string{"hi"})
+		require.Nil(t, err)
+		assert.Equal(t, "there", hi)
+
+		// the nodes resolve the path one after the other without a store
+		path := []string{"child1", "balances", "linked", "hi"}
+		shardDepth := 0
+		for i, n := range nodes {
+			val, remaining, nextShardDepth, err := ResolveNode(n, path, shardDepth)
+			require.Nil(t, err)
+			if i == len(nodes)-1 {
+				assert.Equal(t, "there", val)
+				break
+			}
+			link, ok := val.(*format.Link)
+			require.True(t, ok)
+			assert.True(t, link.Cid.Equals(nodes[i+1].Cid()))
+			path, shardDepth = remaining, nextShardDepth
+		}
+
+		_, err = linked.NodesForPath(ctx, []string{"child1", "balances", "key1"})
+		assert.NotNil(t, err)
+
+		withDescendants, err := linked.NodesForPathWithDecendants(ctx, []string{"child1", "balances"})
+		require.Nil(t, err)
+		assert.True(t, len(withDescendants) > len(nodes))
+
+		var obj map[string]interface{}
+		require.Nil(t, linked.ResolveInto(ctx, []string{"child1", "balances", "linked"}, &obj))
+		assert.Equal(t, map[string]interface{}{"hi": "there"}, obj)
+
+		var balances map[string]interface{}
+		require.Nil(t, linked.ResolveInto(ctx, []string{"child1", "balances"}, &balances))
+		assert.Len(t, balances, count+1)
+		assert.Equal(t, 1, balances["key1"])
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		changed, err := sharded.Set(ctx, []string{"child1", "balances", "key1"}, "changed")
+		require.Nil(t, err)
+		changes, err := Diff(ctx, sharded, changed)
+		require.Nil(t, err)
+		require.Len(t, changes, 1)
+		assert.Equal(t, []string{"child1", "balances", "key1"}, changes[0].Path)
+		assert.Equal(t, "changed", changes[0].NewValue)
+	})
+}
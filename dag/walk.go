@@ -0,0 +1,129 @@
+package dag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// SkipNode can be returned from a WalkFunc to skip the descendants of the node
+// that was just visited.
+var SkipNode = errors.New("skip this node")
+
+// StopWalk can be returned from a WalkFunc to end the walk early without Walk
+// returning an error.
+var StopWalk = errors.New("stop the walk")
+
+// WalkFunc is called by Walk for every node with the path to that node from the tip
+// (an empty path for the tip itself). Returning SkipNode or StopWalk changes the walk
+// and any other error aborts it and is returned from Walk.
+type WalkFunc func(path []string, node format.Node) error
+
+// Walk visits the nodes of the dag depth-first starting at the Tip. Nodes are loaded from
+// the store as they are visited rather than all at once. A node linked from several places
+// is visited once for every path to it, and links to nodes which are missing from the store
+// are skipped. Every node of a sharded map is visited with the path of the map itself and
+// links inside the map get the paths of their keys, as if the map wasn't sharded.
+func (d *Dag) Walk(ctx context.Context, fn WalkFunc) error {
+	root, err := d.Store.Get(ctx, d.Tip)
+	if err != nil {
+		return fmt.Errorf("error getting root: %v", err)
+	}
+	err = d.walk(ctx, []string{}, root, fn)
+	if err == StopWalk {
+		return nil
+	}
+	return err
+}
+
+func (d *Dag) walk(ctx context.Context, path []string, node format.Node, fn WalkFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	err := fn(path, node)
+	if err == SkipNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var links []pathLink
+	if isShardNode(node) {
+		shardNode, err := decodeShardNode(node)
+		if err != nil {
+			return err
+		}
+		collectShardLinks(path, shardNode, &links)
+	} else {
+		obj, _, err := node.Resolve(nil)
+		if err != nil {
+			return fmt.Errorf("error resolving node: %v", err)
+		}
+		collectLinks(path, obj, &links)
+	}
+
+	for _, link := range links {
+		linkNode, err := d.Store.Get(ctx, link.cid)
+		if err != nil && err != format.ErrNotFound {
+			return fmt.Errorf("error getting link: %v", err)
+		}
+		if linkNode == nil {
+			continue
+		}
+		err = d.walk(ctx, link.path, linkNode, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pathLink struct {
+	path []string
+	cid  cid.Cid
+}
+
+// collectLinks finds the links inside a decoded node along with their full paths,
+// in key order so walks are deterministic
+func collectLinks(path []string, obj interface{}, links *[]pathLink) {
+	switch obj := obj.(type) {
+	case cid.Cid:
+		*links = append(*links, pathLink{path: path, cid: obj})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			collectLinks(append(append([]string{}, path...), k), obj[k], links)
+		}
+	case []interface{}:
+		for i, v := range obj {
+			collectLinks(append(append([]string{}, path...), strconv.Itoa(i)), v, links)
+		}
+	}
+}
+
+// collectShardLinks is collectLinks for a node of the sharded map at path, its child nodes
+// are part of the same map and keep its path
+func collectShardLinks(path []string, n *shardNode, links *[]pathLink) {
+	for _, p := range n.Pointers {
+		if p.Link != nil {
+			*links = append(*links, pathLink{path: path, cid: *p.Link})
+			continue
+		}
+		for _, e := range p.Entries {
+			collectLinks(append(append([]string{}, path...), e.Key), e.Value, links)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dag := newDeepAndWideDag(t, ctx)
+
+	var visited []string
+	err := dag.Walk(ctx, func(path []string, node format.Node) error {
+		visited = append(visited, strings.Join(path, "/"))
+		return nil
+	})
+	require.Nil(t, err)
+	// links are followed in key order
+	assert.Equal(t, []string{
+		"",
+		"child1",
+		"child1/deepChild1",
+		"child2",
+		"child2/deepChild2",
+	}, visited)
+
+	t.Run("skipping subtrees", func(t *testing.T) {
+		var visited []string
+		err := dag.Walk(ctx, func(path []string, node format.Node) error {
+			visited = append(visited, strings.Join(path, "/"))
+			if len(path) > 0 && path[0] == "child1" {
+				return SkipNode
+			}
+			return nil
+		})
+		require.Nil(t, err)
+		assert.ElementsMatch(t, []string{"", "child1", "child2", "child2/deepChild2"}, visited)
+	})
+
+	t.Run("stopping", func(t *testing.T) {
+		count := 0
+		err := dag.Walk(ctx, func(path []string, node format.Node) error {
+			count++
+			return StopWalk
+		})
+		require.Nil(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("errors abort", func(t *testing.T) {
+		count := 0
+		err := dag.Walk(ctx, func(path []string, node format.Node) error {
+			count++
+			if len(path) == 1 {
+				return fmt.Errorf("boom")
+			}
+			return nil
+		})
+		require.NotNil(t, err)
+		assert.Equal(t, "boom", err.Error())
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("sharded maps", func(t *testing.T) {
+		sharded, err := dag.ShardMap(ctx, []string{"sharded"})
+		require.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			sharded, err = sharded.Set(ctx, []string{"sharded", fmt.Sprintf("key%d", i)}, i)
+			require.Nil(t, err)
+		}
+		sharded, err = sharded.SetAsLink(ctx, []string{"sharded", "linked"}, map[string]interface{}{"hi": "there"})
+		require.Nil(t, err)
+
+		paths := make(map[string]int)
+		err = sharded.Walk(ctx, func(path []string, node format.Node) error {
+			paths[strings.Join(path, "/")]++
+			return nil
+		})
+		require.Nil(t, err)
+		// every node of the sharded map gets the path of the map
+		assert.Greater(t, paths["sharded"], 1)
+		assert.Equal(t, 1, paths["sharded/linked"])
+		for path := range paths {
+			assert.NotContains(t, path, "pointers", "path %s", path)
+		}
+	})
+}
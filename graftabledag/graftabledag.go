@@ -120,9 +120,9 @@ func (gd *GraftedDag) resolveRecursively(ctx context.Context, path chaintree.Pat
 	switch v := value.(type) {
 	case string:
 		if strings.HasPrefix(v, "did:tupelo:") {
-			didPath := strings.Split(v, "/")
+			didPath := parseDIDPath(v)
 			if PathsContainPrefix(seen, didPath) {
-				return nil, nil, fmt.Errorf("loop detected; some or all of %v was already visited in this resolution", strings.Join(didPath, "/"))
+				return nil, nil, fmt.Errorf("loop detected; some or all of %v was already visited in this resolution", v)
 			}
 			nextSeen = append(nextSeen, didPath)
 			value, remaining, err = gd.resolveGraftedVal(ctx, didPath, remaining, nextSeen)
@@ -141,9 +141,9 @@ func (gd *GraftedDag) resolveRecursively(ctx context.Context, path chaintree.Pat
 		for i, val := range v {
 			if sv, ok := val.(string); ok {
 				if strings.HasPrefix(sv, "did:tupelo:") {
-					didPath := strings.Split(sv, "/")
+					didPath := parseDIDPath(sv)
 					if PathsContainPrefix(seen, didPath) {
-						return nil, nil, fmt.Errorf("loop detected; some or all of %v was already visited in this resolution", strings.Join(didPath, "/"))
+						return nil, nil, fmt.Errorf("loop detected; some or all of %v was already visited in this resolution", sv)
 					}
 					nextSeen = append(nextSeen, didPath)
 					graftedVal, remaining, err := gd.resolveGraftedVal(ctx, didPath, remaining, nextSeen)
@@ -171,6 +171,18 @@ func (gd *GraftedDag) resolveRecursively(ctx context.Context, path chaintree.Pat
 	return value, remaining, nil
 }
 
+// parseDIDPath splits a DID path stored in a dag into its keys. Paths are parsed with
+// chaintree.ParsePath so keys can contain escaped slashes, but paths stored before escaping
+// existed (with other backslashes, empty segments or a trailing slash) aren't valid there
+// and are split on every "/" as they always were. Only old paths containing "\\", "\/" or
+// "\0" are read differently now.
+func parseDIDPath(didPath string) chaintree.Path {
+	if path, err := chaintree.ParsePath(didPath); err == nil {
+		return path
+	}
+	return strings.Split(didPath, "/")
+}
+
 // GlobalResolve works like dag.Resolve but will resolve across multiple chaintrees
 // when it encounters string values that start with `did:tupelo:` (i.e. chaintree DIDs).
 func (gd *GraftedDag) GlobalResolve(ctx context.Context, path chaintree.Path) (value interface{}, remaining chaintree.Path, err error) {
@@ -178,6 +190,34 @@ func (gd *GraftedDag) GlobalResolve(ctx context.Context, path chaintree.Path) (v
 	return gd.resolveRecursively(ctx, path, gd.origin, seen)
 }
 
+// Query works like dag.Query on the origin dag but carries on into other chaintrees
+// when it reaches string values that start with `did:tupelo:`, the same as GlobalResolve.
+// Result paths are the paths the query took from the origin.
+func (gd *GraftedDag) Query(ctx context.Context, query string) ([]*dag.QueryResult, error) {
+	q, err := dag.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run(ctx, gd.origin, gd.graft)
+}
+
+func (gd *GraftedDag) graft(ctx context.Context, val interface{}) (*dag.Dag, []string, bool, error) {
+	v, ok := val.(string)
+	if !ok || !strings.HasPrefix(v, "did:tupelo:") {
+		return nil, nil, false, nil
+	}
+	didPath := parseDIDPath(v)
+	nextDag, err := gd.getChaintreeDag(ctx, didPath[0])
+	if err == chaintree.ErrTipNotFound {
+		// leave precomputed DIDs whose chaintrees don't yet exist as they are
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return nextDag, didPath[1:], true, nil
+}
+
 func (gd *GraftedDag) OriginDag() *dag.Dag {
 	return gd.origin
 }
@@ -364,3 +364,176 @@ func TestGraftedDag_GlobalResolve_BeforeChaintreeExists(t *testing.T) {
 	assert.Equal(t, "did:tupelo:doesnotexistyet/thingy", val)
 	assert.Empty(t, remaining)
 }
+
+func TestGraftedDag_Query(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gd, _ := newGraftedDag(t, ctx)
+
+	results, err := gd.Query(ctx, "tree/data/child2/graft/deepChildBoolVal")
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"tree", "data", "child2", "graft", "deepChildBoolVal"}, results[0].Path)
+	assert.Equal(t, true, results[0].Value)
+
+	results, err = gd.Query(ctx, "tree/data/graftedChildren/*[otherVal = 42]/child2")
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"tree", "data", "graftedChildren", "1", "child2"}, results[0].Path)
+	assert.Equal(t, true, results[0].Value)
+
+	results, err = gd.Query(ctx, "tree/data/mixedSlice/*[. != true]")
+	require.Nil(t, err)
+	values := make([]interface{}, len(results))
+	for i, r := range results {
+		values[i] = r.Value
+	}
+	assert.Equal(t, []interface{}{"mixedString", "stringTest", 42}, values)
+
+	results, err = gd.Query(ctx, "tree/data/**/deepChildIntVal")
+	require.Nil(t, err)
+	paths := make([]string, len(results))
+	for i, r := range results {
+		paths[i] = strings.Join(r.Path, "/")
+	}
+	assert.Equal(t, []string{
+		"tree/data/child2/graft/deepChildIntVal",
+		"tree/data/graftedChildren/0/deepChild/deepChildIntVal",
+		"tree/data/graftedChildren/1/deepChild/deepChildIntVal",
+	}, paths)
+}
+
+func TestGraftedDag_Query_LoopDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gd, _ := newGraftedDagWithLoop(t, ctx)
+
+	_, err := gd.Query(ctx, "tree/data/loop")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "loop detected")
+}
+
+func TestGraftedDag_GlobalResolve_EscapedKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := safewrap.SafeWrap{}
+
+	chain := sw.WrapObject(map[string]interface{}{})
+	data := sw.WrapObject(map[string]interface{}{
+		"https://example.com/a": "escaped",
+	})
+	tree := sw.WrapObject(map[string]interface{}{
+		"data": data.Cid(),
+	})
+	did1 := "did:tupelo:imachaintree"
+	root := sw.WrapObject(map[string]interface{}{
+		"id":    did1,
+		"chain": chain.Cid(),
+		"tree":  tree.Cid(),
+	})
+
+	graftPath := chaintree.Path{did1, "tree", "data", "https://example.com/a"}
+	data2 := sw.WrapObject(map[string]interface{}{
+		"graft": graftPath.String(),
+	})
+	tree2 := sw.WrapObject(map[string]interface{}{
+		"data": data2.Cid(),
+	})
+	root2 := sw.WrapObject(map[string]interface{}{
+		"id":    "did:tupelo:imachaintreetoo",
+		"chain": chain.Cid(),
+		"tree":  tree2.Cid(),
+	})
+	require.Nil(t, sw.Err)
+
+	store, err := nodestore.MemoryStore(ctx)
+	require.Nil(t, err)
+	dag1, err := dag.NewDagWithNodes(ctx, store, root, chain, tree, data)
+	require.Nil(t, err)
+	dag2, err := dag.NewDagWithNodes(ctx, store, root2, chain, tree2, data2)
+	require.Nil(t, err)
+
+	gd, err := New(dag2, newDagGetter(t, ctx, dag1, dag2))
+	require.Nil(t, err)
+
+	val, remaining, err := gd.GlobalResolve(ctx, chaintree.Path{"tree", "data", "graft"})
+	require.Nil(t, err)
+	assert.Empty(t, remaining)
+	assert.Equal(t, "escaped", val)
+
+	results, err := gd.Query(ctx, "tree/data/graft")
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "escaped", results[0].Value)
+}
+
+func TestGraftedDag_GlobalResolve_UnescapedPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := safewrap.SafeWrap{}
+
+	chain := sw.WrapObject(map[string]interface{}{})
+	data := sw.WrapObject(map[string]interface{}{
+		`back\slash`: "unescaped",
+		"plain":      "value",
+	})
+	tree := sw.WrapObject(map[string]interface{}{
+		"data": data.Cid(),
+	})
+	did1 := "did:tupelo:imachaintree"
+	root := sw.WrapObject(map[string]interface{}{
+		"id":    did1,
+		"chain": chain.Cid(),
+		"tree":  tree.Cid(),
+	})
+
+	// paths stored before keys were escaped, which aren't valid for chaintree.ParsePath
+	data2 := sw.WrapObject(map[string]interface{}{
+		"backslash": did1 + `/tree/data/back\slash`,
+		"trailing":  did1 + "/tree/data/",
+		"double":    did1 + "/tree//data",
+	})
+	tree2 := sw.WrapObject(map[string]interface{}{
+		"data": data2.Cid(),
+	})
+	root2 := sw.WrapObject(map[string]interface{}{
+		"id":    "did:tupelo:imachaintreetoo",
+		"chain": chain.Cid(),
+		"tree":  tree2.Cid(),
+	})
+	require.Nil(t, sw.Err)
+
+	store, err := nodestore.MemoryStore(ctx)
+	require.Nil(t, err)
+	dag1, err := dag.NewDagWithNodes(ctx, store, root, chain, tree, data)
+	require.Nil(t, err)
+	dag2, err := dag.NewDagWithNodes(ctx, store, root2, chain, tree2, data2)
+	require.Nil(t, err)
+
+	gd, err := New(dag2, newDagGetter(t, ctx, dag1, dag2))
+	require.Nil(t, err)
+
+	val, remaining, err := gd.GlobalResolve(ctx, chaintree.Path{"tree", "data", "backslash"})
+	require.Nil(t, err)
+	assert.Empty(t, remaining)
+	assert.Equal(t, "unescaped", val)
+
+	results, err := gd.Query(ctx, "tree/data/backslash")
+	require.Nil(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "unescaped", results[0].Value)
+
+	// empty segments are kept as empty keys, as they always were
+	for _, key := range []string{"trailing", "double"} {
+		_, remaining, err := gd.GlobalResolve(ctx, chaintree.Path{"tree", "data", key})
+		require.Nil(t, err, key)
+		assert.Equal(t, chaintree.Path{""}, remaining[:1], key)
+
+		_, err = gd.Query(ctx, "tree/data/"+key)
+		require.Nil(t, err, key)
+	}
+}
@@ -0,0 +1,101 @@
+package nodestore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// GCReport describes the outcome of CollectGarbage
+type GCReport struct {
+	// DryRun is true when nothing was actually deleted
+	DryRun bool
+	// Kept is the number of nodes reachable from the tips
+	Kept int
+	// Removed holds the CIDs which were deleted (or would be deleted in a dry run)
+	Removed []cid.Cid
+}
+
+// CollectGarbage does a mark-and-sweep over the blocks stored in ds (as written by the
+// DagStores returned from FromDatastoreOffline and FromDatastoreOfflineCached). Everything
+// reachable from one of the tips is kept and every other block is deleted. With dryRun set
+// nothing is deleted and the report lists what would have been.
+//
+// Nothing may be written to ds while this runs, and DagStores with a cache in front of ds
+// can still return removed nodes from that cache.
+func CollectGarbage(ctx context.Context, ds datastore.Batching, tips []cid.Cid, dryRun bool) (*GCReport, error) {
+	bs := blockstoreFromDatastore(ds, -1)
+	return collectGarbage(ctx, bs, tips, dryRun, bs.DeleteBlock)
+}
+
+func collectGarbage(ctx context.Context, bs blockstore.Blockstore, tips []cid.Cid, dryRun bool, remove func(cid.Cid) error) (*GCReport, error) {
+	dagService := merkledag.NewDAGService(blockservice.New(bs, &nullExchange{}))
+
+	marked, err := mark(ctx, dagService, tips)
+	if err != nil {
+		return nil, fmt.Errorf("error marking nodes: %v", err)
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys: %v", err)
+	}
+
+	// collect the garbage first so nothing is deleted while the keys are being listed
+	var garbage []cid.Cid
+	for id := range keys {
+		if _, ok := marked[id]; !ok {
+			garbage = append(garbage, id)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if !dryRun {
+		for _, id := range garbage {
+			err := remove(id)
+			if err != nil {
+				return nil, fmt.Errorf("error deleting block (%s): %v", id.String(), err)
+			}
+		}
+	}
+
+	return &GCReport{
+		DryRun:  dryRun,
+		Kept:    len(marked),
+		Removed: garbage,
+	}, nil
+}
+
+// mark returns every CID reachable from tips, links to missing nodes are ignored
+func mark(ctx context.Context, store format.NodeGetter, tips []cid.Cid) (map[cid.Cid]struct{}, error) {
+	marked := make(map[cid.Cid]struct{})
+	stack := append([]cid.Cid{}, tips...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := marked[id]; ok {
+			continue
+		}
+
+		n, err := store.Get(ctx, id)
+		if err == format.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting node (%s): %v", id.String(), err)
+		}
+		marked[id] = struct{}{}
+		for _, l := range n.Links() {
+			stack = append(stack, l.Cid)
+		}
+	}
+	return marked, nil
+}
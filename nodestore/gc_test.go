@@ -0,0 +1,59 @@
+package nodestore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsync.MutexWrap(datastore.NewMapDatastore())
+	store, err := FromDatastoreOffline(ctx, ds)
+	require.Nil(t, err)
+
+	sw := safewrap.SafeWrap{}
+	shared := sw.WrapObject(map[string]string{"shared": "node"})
+	oldRoot := sw.WrapObject(map[string]interface{}{"shared": shared.Cid(), "old": true})
+	oldChild := sw.WrapObject(map[string]string{"old": "child"})
+	oldRootWithChild := sw.WrapObject(map[string]interface{}{"child": oldChild.Cid()})
+	root := sw.WrapObject(map[string]interface{}{"shared": shared.Cid(), "new": true})
+	require.Nil(t, sw.Err)
+
+	err = store.AddMany(ctx, []format.Node{shared, oldRoot, oldChild, oldRootWithChild, root})
+	require.Nil(t, err)
+
+	report, err := CollectGarbage(ctx, ds, []cid.Cid{root.Cid(), oldRoot.Cid()}, true)
+	require.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 3, report.Kept)
+	assert.ElementsMatch(t, []cid.Cid{oldChild.Cid(), oldRootWithChild.Cid()}, report.Removed)
+
+	// a dry run leaves everything in place
+	_, err = store.Get(ctx, oldChild.Cid())
+	require.Nil(t, err)
+
+	report, err = CollectGarbage(ctx, ds, []cid.Cid{root.Cid()}, false)
+	require.Nil(t, err)
+	assert.False(t, report.DryRun)
+	assert.Equal(t, 2, report.Kept)
+	assert.Len(t, report.Removed, 3)
+
+	for _, n := range []format.Node{root, shared} {
+		_, err := store.Get(ctx, n.Cid())
+		require.Nil(t, err)
+	}
+	for _, n := range []format.Node{oldRoot, oldChild, oldRootWithChild} {
+		_, err := store.Get(ctx, n.Cid())
+		assert.Equal(t, format.ErrNotFound, err)
+	}
+}
@@ -0,0 +1,150 @@
+package nodestore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// OverlayStore is a DagStore which reads through to an underlying DagStore but
+// keeps every node added to it in memory. Nothing is written to the underlying store
+// until Commit is called, so it can be used to try out changes and throw them away.
+// Remove only ever removes nodes from the overlay itself.
+type OverlayStore struct {
+	underlying DagStore
+	lock       sync.RWMutex
+	added      map[cid.Cid]format.Node
+}
+
+var _ DagStore = (*OverlayStore)(nil)
+
+// NewOverlay returns an empty OverlayStore on top of underlying
+func NewOverlay(underlying DagStore) *OverlayStore {
+	return &OverlayStore{
+		underlying: underlying,
+		added:      make(map[cid.Cid]format.Node),
+	}
+}
+
+// Underlying returns the store the overlay reads through to
+func (o *OverlayStore) Underlying() DagStore {
+	return o.underlying
+}
+
+func (o *OverlayStore) Get(ctx context.Context, id cid.Cid) (format.Node, error) {
+	o.lock.RLock()
+	n, ok := o.added[id]
+	o.lock.RUnlock()
+	if ok {
+		return n, nil
+	}
+	return o.underlying.Get(ctx, id)
+}
+
+func (o *OverlayStore) GetMany(ctx context.Context, ids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(ids))
+	go func() {
+		defer close(out)
+		for _, id := range ids {
+			n, err := o.Get(ctx, id)
+			select {
+			case out <- &format.NodeOption{Node: n, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (o *OverlayStore) Add(_ context.Context, n format.Node) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.added[n.Cid()] = n
+	return nil
+}
+
+func (o *OverlayStore) AddMany(ctx context.Context, nodes []format.Node) error {
+	for _, n := range nodes {
+		if err := o.Add(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayStore) Remove(_ context.Context, id cid.Cid) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.added, id)
+	return nil
+}
+
+func (o *OverlayStore) RemoveMany(ctx context.Context, ids []cid.Cid) error {
+	for _, id := range ids {
+		if err := o.Remove(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Added returns every node which has been added to the overlay (reachable or not)
+func (o *OverlayStore) Added() []format.Node {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	nodes := make([]format.Node, 0, len(o.added))
+	for _, n := range o.added {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// Reachable returns the nodes which only exist in the overlay and are reachable
+// from one of the tips. Links into the underlying store are not followed as
+// everything below them is already there.
+func (o *OverlayStore) Reachable(tips ...cid.Cid) []format.Node {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	seen := make(map[cid.Cid]struct{})
+	var nodes []format.Node
+	stack := append([]cid.Cid{}, tips...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		n, ok := o.added[id]
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, n)
+		for _, l := range n.Links() {
+			stack = append(stack, l.Cid)
+		}
+	}
+	return nodes
+}
+
+// Commit writes the nodes which are reachable from the tips (see Reachable) to the
+// underlying store in one AddMany and returns them. Unreachable nodes are discarded.
+func (o *OverlayStore) Commit(ctx context.Context, tips ...cid.Cid) ([]format.Node, error) {
+	nodes := o.Reachable(tips...)
+	err := o.underlying.AddMany(ctx, nodes)
+	if err != nil {
+		return nil, fmt.Errorf("error adding nodes: %v", err)
+	}
+
+	o.lock.Lock()
+	o.added = make(map[cid.Cid]format.Node)
+	o.lock.Unlock()
+
+	return nodes, nil
+}
@@ -0,0 +1,59 @@
+package nodestore
+
+import (
+	"context"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlayStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	underlying := MustMemoryStore(ctx)
+
+	sw := safewrap.SafeWrap{}
+	existing := sw.WrapObject(map[string]string{"existing": "node"})
+	child := sw.WrapObject(map[string]string{"child": "node"})
+	orphan := sw.WrapObject(map[string]string{"orphan": "node"})
+	root := sw.WrapObject(map[string]interface{}{"child": child.Cid(), "existing": existing.Cid()})
+	require.Nil(t, sw.Err)
+
+	err := underlying.Add(ctx, existing)
+	require.Nil(t, err)
+
+	overlay := NewOverlay(underlying)
+	err = overlay.AddMany(ctx, []format.Node{root, child, orphan})
+	require.Nil(t, err)
+
+	// reads come from both the overlay and the underlying store
+	for _, n := range []format.Node{root, child, orphan, existing} {
+		got, err := overlay.Get(ctx, n.Cid())
+		require.Nil(t, err)
+		assert.Equal(t, n.Cid(), got.Cid())
+	}
+
+	// but nothing has been written yet
+	_, err = underlying.Get(ctx, root.Cid())
+	assert.Equal(t, format.ErrNotFound, err)
+	assert.Len(t, overlay.Added(), 3)
+
+	reachable := overlay.Reachable(root.Cid())
+	assert.Len(t, reachable, 2)
+
+	committed, err := overlay.Commit(ctx, root.Cid())
+	require.Nil(t, err)
+	assert.Len(t, committed, 2)
+	assert.Len(t, overlay.Added(), 0)
+
+	for _, n := range []format.Node{root, child} {
+		_, err := underlying.Get(ctx, n.Cid())
+		require.Nil(t, err)
+	}
+	_, err = underlying.Get(ctx, orphan.Cid())
+	assert.Equal(t, format.ErrNotFound, err)
+}
@@ -0,0 +1,157 @@
+package nodestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	badger "github.com/ipfs/go-ds-badger"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// ErrClosed is returned from a PersistentStore which has been closed
+var ErrClosed = fmt.Errorf("store is closed")
+
+// blocksPrefix is where the blockstore keeps its blocks in the datastore
+var blocksPrefix = datastore.NewKey("/blocks")
+
+// BadgerOptions tune the store returned from Badger, the zero value gives sensible defaults
+type BadgerOptions struct {
+	// CacheSize is the number of nodes kept in an in-memory LRU cache, 0 turns the cache off
+	CacheSize int
+	// SyncWrites makes every write wait until it is on disk
+	SyncWrites bool
+}
+
+// PersistentStore is a DagStore backed by an on-disk datastore. It must be closed when it is
+// no longer needed, after that every call returns ErrClosed.
+type PersistentStore struct {
+	store  DagStore
+	ds     datastore.Batching
+	closer io.Closer
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+var _ DagStore = (*PersistentStore)(nil)
+
+// Badger returns a store kept in a badger database in the directory at path (created when
+// missing). Badger stores any key, so Datastore can be shared with a HeightIndex, a PinnedStore
+// or CollectGarbage. opts may be nil.
+func Badger(path string, opts *BadgerOptions) (*PersistentStore, error) {
+	if opts == nil {
+		opts = &BadgerOptions{}
+	}
+	badgerOpts := badger.DefaultOptions
+	badgerOpts.SyncWrites = opts.SyncWrites
+
+	ds, err := badger.NewDatastore(path, &badgerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error opening badger datastore: %v", err)
+	}
+	return newPersistentStore(ds, ds, opts.CacheSize), nil
+}
+
+// Flatfs returns a store which keeps every node in its own file below the directory at path
+// (created when missing), using the same sharding as go-ipfs. Flatfs can only store nodes so
+// Datastore only accepts the keys a DagStore writes.
+func Flatfs(path string) (*PersistentStore, error) {
+	fs, err := flatfs.CreateOrOpen(path, flatfs.IPFS_DEF_SHARD, false)
+	if err != nil {
+		return nil, fmt.Errorf("error opening flatfs datastore: %v", err)
+	}
+	ds := mount.New([]mount.Mount{{Prefix: blocksPrefix, Datastore: fs}})
+	return newPersistentStore(ds, ds, -1), nil
+}
+
+func newPersistentStore(ds datastore.Batching, closer io.Closer, cacheSize int) *PersistentStore {
+	return &PersistentStore{
+		store:  dagstoreFromBlockstore(blockstoreFromDatastore(ds, cacheSize)),
+		ds:     ds,
+		closer: closer,
+	}
+}
+
+// Datastore returns the underlying datastore
+func (ps *PersistentStore) Datastore() datastore.Batching {
+	return ps.ds
+}
+
+// Close waits for running calls to finish and closes the datastore, closing
+// more than once is a no-op
+func (ps *PersistentStore) Close() error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if ps.closed {
+		return nil
+	}
+	ps.closed = true
+	return ps.closer.Close()
+}
+
+func (ps *PersistentStore) Get(ctx context.Context, id cid.Cid) (format.Node, error) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if ps.closed {
+		return nil, ErrClosed
+	}
+	return ps.store.Get(ctx, id)
+}
+
+func (ps *PersistentStore) GetMany(ctx context.Context, ids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(ids))
+	go func() {
+		defer close(out)
+		for _, id := range ids {
+			n, err := ps.Get(ctx, id)
+			select {
+			case out <- &format.NodeOption{Node: n, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (ps *PersistentStore) Add(ctx context.Context, n format.Node) error {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	return ps.store.Add(ctx, n)
+}
+
+func (ps *PersistentStore) AddMany(ctx context.Context, nodes []format.Node) error {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	return ps.store.AddMany(ctx, nodes)
+}
+
+func (ps *PersistentStore) Remove(ctx context.Context, id cid.Cid) error {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	return ps.store.Remove(ctx, id)
+}
+
+func (ps *PersistentStore) RemoveMany(ctx context.Context, ids []cid.Cid) error {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	return ps.store.RemoveMany(ctx, ids)
+}
@@ -0,0 +1,77 @@
+package nodestore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentStores(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, test := range []struct {
+		description string
+		open        func(path string) (*PersistentStore, error)
+		cached      bool
+	}{
+		{description: "badger", open: func(path string) (*PersistentStore, error) { return Badger(path, nil) }},
+		{description: "badger with a cache", open: func(path string) (*PersistentStore, error) {
+			return Badger(path, &BadgerOptions{CacheSize: 10, SyncWrites: true})
+		}, cached: true},
+		{description: "flatfs", open: Flatfs},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "nodestore")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			store, err := test.open(dir)
+			require.Nil(t, err)
+
+			sw := safewrap.SafeWrap{}
+			child := sw.WrapObject(map[string]string{"child": "node"})
+			root := sw.WrapObject(map[string]interface{}{"child": child.Cid()})
+			require.Nil(t, sw.Err)
+
+			err = store.AddMany(ctx, []format.Node{root, child})
+			require.Nil(t, err)
+
+			require.Nil(t, store.Close())
+			require.Nil(t, store.Close())
+			_, err = store.Get(ctx, root.Cid())
+			assert.Equal(t, ErrClosed, err)
+			assert.Equal(t, ErrClosed, store.Add(ctx, root))
+
+			// everything is still there after reopening
+			store, err = test.open(dir)
+			require.Nil(t, err)
+			defer store.Close()
+
+			for _, n := range []format.Node{root, child} {
+				got, err := store.Get(ctx, n.Cid())
+				require.Nil(t, err)
+				assert.Equal(t, n.RawData(), got.RawData())
+			}
+
+			if test.cached {
+				// the cache would keep serving collected nodes, see CollectGarbage
+				return
+			}
+
+			// and the datastore can be garbage collected
+			report, err := CollectGarbage(ctx, store.Datastore(), []cid.Cid{child.Cid()}, false)
+			require.Nil(t, err)
+			assert.Len(t, report.Removed, 1)
+			_, err = store.Get(ctx, root.Cid())
+			assert.Equal(t, format.ErrNotFound, err)
+		})
+	}
+}
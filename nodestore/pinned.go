@@ -0,0 +1,416 @@
+package nodestore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+var (
+	pinsPrefix = datastore.NewKey("/pins")
+	refsPrefix = datastore.NewKey("/refs")
+)
+
+// ErrNotPinned is returned from Unpin for tips which aren't pinned
+var ErrNotPinned = fmt.Errorf("not pinned")
+
+// PinnedStore is a DagStore which keeps a pin set and a reference count for every node in
+// the same datastore as the nodes themselves. The reference count of a node is the number
+// of stored nodes linking to it plus one if it is pinned. Unpin reclaims the nodes whose
+// count drops to zero, so releasing an old tip removes everything only it was using. Every
+// change writes its nodes, counts and pins in a single datastore batch.
+//
+// Nodes which are added but never pinned or linked to are not reclaimed by Unpin, use
+// CollectGarbage to get rid of those.
+type PinnedStore struct {
+	DagStore
+
+	ds   datastore.Batching
+	bs   blockstore.Blockstore
+	lock sync.Mutex
+}
+
+var _ DagStore = (*PinnedStore)(nil)
+
+// NewPinnedStore returns a PinnedStore keeping its nodes, pins and reference counts in ds
+func NewPinnedStore(_ context.Context, ds datastore.Batching) (*PinnedStore, error) {
+	bs := blockstoreFromDatastore(ds, -1)
+	return &PinnedStore{
+		DagStore: dagstoreFromBlockstore(bs),
+		ds:       ds,
+		bs:       bs,
+	}, nil
+}
+
+// Add stores the node and, if it wasn't already stored, increments the reference
+// counts of the nodes it links to
+func (ps *PinnedStore) Add(ctx context.Context, n format.Node) error {
+	return ps.AddMany(ctx, []format.Node{n})
+}
+
+func (ps *PinnedStore) AddMany(ctx context.Context, nodes []format.Node) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.update(ctx, func(b *pinBatch) error {
+		for _, n := range nodes {
+			if err := b.add(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the node and decrements the reference counts of the nodes it links to.
+// Those are not reclaimed even if they are no longer referenced.
+func (ps *PinnedStore) Remove(ctx context.Context, id cid.Cid) error {
+	return ps.RemoveMany(ctx, []cid.Cid{id})
+}
+
+func (ps *PinnedStore) RemoveMany(ctx context.Context, ids []cid.Cid) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.update(ctx, func(b *pinBatch) error {
+		for _, id := range ids {
+			if err := b.remove(ctx, id, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Pin adds tip to the pin set, every node below tip has to be in the store. The nodes
+// tip links to are kept for as long as tip is.
+func (ps *PinnedStore) Pin(ctx context.Context, tip cid.Cid) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	err := ps.checkComplete(ctx, tip)
+	if err != nil {
+		return fmt.Errorf("error pinning %s: %v", tip.String(), err)
+	}
+
+	return ps.update(ctx, func(b *pinBatch) error {
+		key := pinsPrefix.ChildString(tip.String())
+		wasPinned, err := b.has(key)
+		if err != nil {
+			return fmt.Errorf("error getting pin: %v", err)
+		}
+		if wasPinned {
+			return nil
+		}
+		err = b.put(key, []byte{})
+		if err != nil {
+			return fmt.Errorf("error putting pin: %v", err)
+		}
+		_, err = b.addRef(tip, 1)
+		return err
+	})
+}
+
+// Unpin removes tip from the pin set and reclaims it, and everything below it, as far
+// as nothing else still references those nodes
+func (ps *PinnedStore) Unpin(ctx context.Context, tip cid.Cid) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	return ps.update(ctx, func(b *pinBatch) error {
+		key := pinsPrefix.ChildString(tip.String())
+		wasPinned, err := b.has(key)
+		if err != nil {
+			return fmt.Errorf("error getting pin: %v", err)
+		}
+		if !wasPinned {
+			return ErrNotPinned
+		}
+		err = b.delete(key)
+		if err != nil {
+			return fmt.Errorf("error deleting pin: %v", err)
+		}
+
+		refs, err := b.addRef(tip, -1)
+		if err != nil {
+			return err
+		}
+		if refs == 0 {
+			return b.remove(ctx, tip, true)
+		}
+		return nil
+	})
+}
+
+// ListPins returns the whole pin set
+func (ps *PinnedStore) ListPins(_ context.Context) ([]cid.Cid, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.listPins()
+}
+
+func (ps *PinnedStore) listPins() ([]cid.Cid, error) {
+	results, err := ps.ds.Query(query.Query{Prefix: pinsPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("error querying pins: %v", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, fmt.Errorf("error querying pins: %v", err)
+	}
+
+	pins := make([]cid.Cid, len(entries))
+	for i, entry := range entries {
+		id, err := cid.Decode(datastore.NewKey(entry.Key).BaseNamespace())
+		if err != nil {
+			return nil, fmt.Errorf("error decoding pin %s: %v", entry.Key, err)
+		}
+		pins[i] = id
+	}
+	return pins, nil
+}
+
+// RefCount returns the current reference count of a node
+func (ps *PinnedStore) RefCount(_ context.Context, id cid.Cid) (uint64, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return getRef(ps.ds, id)
+}
+
+// CollectGarbage removes every node which isn't reachable from the pin set, see the
+// package level CollectGarbage. Reference counts are kept up to date. The store is
+// locked for the whole collection, so the pin set can't change while it is marked.
+func (ps *PinnedStore) CollectGarbage(ctx context.Context, dryRun bool) (*GCReport, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	tips, err := ps.listPins()
+	if err != nil {
+		return nil, err
+	}
+
+	var report *GCReport
+	err = ps.update(ctx, func(b *pinBatch) error {
+		var err error
+		report, err = collectGarbage(ctx, ps.bs, tips, dryRun, func(id cid.Cid) error {
+			return b.remove(ctx, id, false)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (ps *PinnedStore) checkComplete(ctx context.Context, tip cid.Cid) error {
+	seen := make(map[cid.Cid]struct{})
+	stack := []cid.Cid{tip}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		n, err := ps.DagStore.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("error getting node (%s): %v", id.String(), err)
+		}
+		for _, l := range n.Links() {
+			stack = append(stack, l.Cid)
+		}
+	}
+	return nil
+}
+
+// update runs fn with a new batch and commits it when fn succeeds, the caller must
+// hold the lock
+func (ps *PinnedStore) update(ctx context.Context, fn func(b *pinBatch) error) error {
+	batch, err := ps.ds.Batch()
+	if err != nil {
+		return fmt.Errorf("error creating batch: %v", err)
+	}
+	b := &pinBatch{
+		ps:      ps,
+		batch:   batch,
+		pending: make(map[datastore.Key][]byte),
+		nodes:   make(map[cid.Cid]format.Node),
+	}
+	if err := fn(b); err != nil {
+		return err
+	}
+	err = batch.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing batch: %v", err)
+	}
+	return nil
+}
+
+// pinBatch gathers the writes of a single change to a PinnedStore. Reads go through it
+// so they see what was already written in the batch.
+type pinBatch struct {
+	ps    *PinnedStore
+	batch datastore.Batch
+	// pending holds every key written in the batch, nil for deleted keys
+	pending map[datastore.Key][]byte
+	// nodes holds the nodes added in the batch
+	nodes map[cid.Cid]format.Node
+}
+
+// blockKey is the key the blockstore keeps the node id under
+func blockKey(id cid.Cid) datastore.Key {
+	return blockstore.BlockPrefix.Child(dshelp.CidToDsKey(id))
+}
+
+func (b *pinBatch) get(key datastore.Key) ([]byte, error) {
+	if val, ok := b.pending[key]; ok {
+		if val == nil {
+			return nil, datastore.ErrNotFound
+		}
+		return val, nil
+	}
+	return b.ps.ds.Get(key)
+}
+
+func (b *pinBatch) has(key datastore.Key) (bool, error) {
+	if val, ok := b.pending[key]; ok {
+		return val != nil, nil
+	}
+	return b.ps.ds.Has(key)
+}
+
+func (b *pinBatch) put(key datastore.Key, val []byte) error {
+	b.pending[key] = val
+	return b.batch.Put(key, val)
+}
+
+func (b *pinBatch) delete(key datastore.Key) error {
+	b.pending[key] = nil
+	return b.batch.Delete(key)
+}
+
+func (b *pinBatch) getNode(ctx context.Context, id cid.Cid) (format.Node, error) {
+	if n, ok := b.nodes[id]; ok {
+		return n, nil
+	}
+	if val, ok := b.pending[blockKey(id)]; ok && val == nil {
+		return nil, format.ErrNotFound
+	}
+	return b.ps.DagStore.Get(ctx, id)
+}
+
+// add stores the node and counts its links, unless it was already stored
+func (b *pinBatch) add(n format.Node) error {
+	key := blockKey(n.Cid())
+	has, err := b.has(key)
+	if err != nil {
+		return fmt.Errorf("error checking for node (%s): %v", n.Cid().String(), err)
+	}
+	if has {
+		return nil
+	}
+	err = b.put(key, n.RawData())
+	if err != nil {
+		return fmt.Errorf("error adding node (%s): %v", n.Cid().String(), err)
+	}
+	b.nodes[n.Cid()] = n
+
+	for _, l := range n.Links() {
+		if _, err := b.addRef(l.Cid, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a node and releases its links, with reclaim set the linked nodes are
+// removed as well once nothing references them anymore
+func (b *pinBatch) remove(ctx context.Context, id cid.Cid, reclaim bool) error {
+	n, err := b.getNode(ctx, id)
+	if err == format.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting node (%s): %v", id.String(), err)
+	}
+
+	err = b.delete(blockKey(id))
+	if err != nil {
+		return fmt.Errorf("error removing node (%s): %v", id.String(), err)
+	}
+	delete(b.nodes, id)
+
+	for _, l := range n.Links() {
+		refs, err := b.addRef(l.Cid, -1)
+		if err != nil {
+			return err
+		}
+		if reclaim && refs == 0 {
+			if err := b.remove(ctx, l.Cid, reclaim); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addRef changes the reference count of id by delta and returns the new count,
+// counts never go below zero and are deleted once they reach it
+func (b *pinBatch) addRef(id cid.Cid, delta int) (uint64, error) {
+	key := refsPrefix.ChildString(id.String())
+	refs, err := decodeRef(b.get(key))
+	if err != nil {
+		return 0, fmt.Errorf("error getting reference count (%s): %v", id.String(), err)
+	}
+	switch {
+	case delta < 0 && refs < uint64(-delta):
+		refs = 0
+	case delta < 0:
+		refs -= uint64(-delta)
+	default:
+		refs += uint64(delta)
+	}
+
+	if refs == 0 {
+		err = b.delete(key)
+		if err != nil {
+			return 0, fmt.Errorf("error removing reference count (%s): %v", id.String(), err)
+		}
+		return 0, nil
+	}
+
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, refs)
+	err = b.put(key, val)
+	if err != nil {
+		return 0, fmt.Errorf("error putting reference count (%s): %v", id.String(), err)
+	}
+	return refs, nil
+}
+
+func getRef(ds datastore.Datastore, id cid.Cid) (uint64, error) {
+	refs, err := decodeRef(ds.Get(refsPrefix.ChildString(id.String())))
+	if err != nil {
+		return 0, fmt.Errorf("error getting reference count (%s): %v", id.String(), err)
+	}
+	return refs, nil
+}
+
+// decodeRef decodes a stored reference count, a missing count is zero
+func decodeRef(val []byte, err error) (uint64, error) {
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
@@ -0,0 +1,138 @@
+package nodestore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/quorumcontrol/chaintree/safewrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinnedStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsync.MutexWrap(datastore.NewMapDatastore())
+	store, err := NewPinnedStore(ctx, ds)
+	require.Nil(t, err)
+
+	sw := safewrap.SafeWrap{}
+	shared := sw.WrapObject(map[string]string{"shared": "node"})
+	oldChild := sw.WrapObject(map[string]string{"old": "child"})
+	oldRoot := sw.WrapObject(map[string]interface{}{"shared": shared.Cid(), "child": oldChild.Cid()})
+	root := sw.WrapObject(map[string]interface{}{"shared": shared.Cid(), "new": true})
+	orphan := sw.WrapObject(map[string]string{"orphan": "node"})
+	require.Nil(t, sw.Err)
+
+	err = store.AddMany(ctx, []format.Node{shared, oldChild, oldRoot, root, orphan})
+	require.Nil(t, err)
+	// adding again doesn't count twice
+	err = store.Add(ctx, oldRoot)
+	require.Nil(t, err)
+
+	refs, err := store.RefCount(ctx, shared.Cid())
+	require.Nil(t, err)
+	assert.Equal(t, uint64(2), refs)
+
+	err = store.Pin(ctx, oldRoot.Cid())
+	require.Nil(t, err)
+	err = store.Pin(ctx, root.Cid())
+	require.Nil(t, err)
+	// pinning twice doesn't count twice
+	err = store.Pin(ctx, root.Cid())
+	require.Nil(t, err)
+
+	pins, err := store.ListPins(ctx)
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []cid.Cid{oldRoot.Cid(), root.Cid()}, pins)
+
+	// the pin set and counts live in the datastore
+	reopened, err := NewPinnedStore(ctx, ds)
+	require.Nil(t, err)
+	pins, err = reopened.ListPins(ctx)
+	require.Nil(t, err)
+	assert.Len(t, pins, 2)
+
+	err = store.Unpin(ctx, oldRoot.Cid())
+	require.Nil(t, err)
+	err = store.Unpin(ctx, oldRoot.Cid())
+	assert.Equal(t, ErrNotPinned, err)
+
+	for _, n := range []format.Node{oldRoot, oldChild} {
+		_, err := store.Get(ctx, n.Cid())
+		assert.Equal(t, format.ErrNotFound, err)
+	}
+	for _, n := range []format.Node{root, shared, orphan} {
+		_, err := store.Get(ctx, n.Cid())
+		require.Nil(t, err)
+	}
+	refs, err = store.RefCount(ctx, shared.Cid())
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), refs)
+
+	report, err := store.CollectGarbage(ctx, false)
+	require.Nil(t, err)
+	assert.Equal(t, 2, report.Kept)
+	assert.Len(t, report.Removed, 1)
+	assert.True(t, report.Removed[0].Equals(orphan.Cid()))
+
+	t.Run("pins need the whole dag", func(t *testing.T) {
+		missing := sw.WrapObject(map[string]string{"missing": "node"})
+		parent := sw.WrapObject(map[string]interface{}{"missing": missing.Cid()})
+		require.Nil(t, sw.Err)
+		err := store.Add(ctx, parent)
+		require.Nil(t, err)
+
+		err = store.Pin(ctx, parent.Cid())
+		assert.NotNil(t, err)
+		pins, err := store.ListPins(ctx)
+		require.Nil(t, err)
+		assert.Len(t, pins, 1)
+	})
+
+	t.Run("nodes and counts are written together", func(t *testing.T) {
+		failing, err := NewPinnedStore(ctx, &failingBatchDatastore{Batching: ds})
+		require.Nil(t, err)
+
+		child := sw.WrapObject(map[string]string{"batched": "child"})
+		parent := sw.WrapObject(map[string]interface{}{"child": child.Cid()})
+		require.Nil(t, sw.Err)
+		err = failing.AddMany(ctx, []format.Node{child, parent})
+		require.NotNil(t, err)
+
+		for _, n := range []format.Node{child, parent} {
+			_, err := store.Get(ctx, n.Cid())
+			assert.Equal(t, format.ErrNotFound, err)
+		}
+		refs, err := store.RefCount(ctx, child.Cid())
+		require.Nil(t, err)
+		assert.Equal(t, uint64(0), refs)
+	})
+}
+
+// failingBatchDatastore never commits a batch
+type failingBatchDatastore struct {
+	datastore.Batching
+}
+
+func (ds *failingBatchDatastore) Batch() (datastore.Batch, error) {
+	batch, err := ds.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &failingBatch{Batch: batch}, nil
+}
+
+type failingBatch struct {
+	datastore.Batch
+}
+
+func (b *failingBatch) Commit() error {
+	return fmt.Errorf("commit failed")
+}